@@ -24,8 +24,18 @@ func AddCommonFlags(cmd *cobra.Command, cfg *cluster.ClusterStoreConnInfo, logLe
 		"certificate file for client identification to the store")
 	cmd.PersistentFlags().StringVar(&cfg.StoreConnInfo.Key, "store-key", "",
 		"private key file for client identification to the store")
+	cmd.PersistentFlags().StringVar(&cfg.FallbackStoreConnInfo.Endpoints, "fallback-store-endpoints", "",
+		"a comma-delimited list of disaster recovery store endpoints, used when the main store is unavailable. TLS files of the main store are used.")
+	cmd.PersistentFlags().BoolVar(&cfg.FallbackWrites, "fallback-store-writes", false,
+		"write to the fallback store too when the main one is unavailable; by default, only reads are allowed")
 	cmd.PersistentFlags().IntVar(&cfg.RequestTimeout, "request-timeout",
 		5, "store timeout in seconds")
+	cmd.PersistentFlags().IntVar(&cfg.BreakerThreshold, "store-breaker-threshold", 0,
+		"after this many consecutive store failures, fail store requests immediately for a cooldown period; 0 disables")
+	cmd.PersistentFlags().IntVar(&cfg.BreakerCooldown, "store-breaker-cooldown", 10,
+		"store circuit breaker cooldown in seconds")
+	cmd.PersistentFlags().StringVar(&cfg.EncryptionKeyFile, "store-encryption-key-file", "",
+		"file with hex-encoded AES key used to encrypt passwords in cluster data stored in the store")
 
 	cmd.PersistentFlags().StringVar(logLevel, "log-level", "info",
 		"error|warn|info|debug")
@@ -19,7 +19,6 @@ import (
 
 	"github.com/jackc/pgx"
 	"github.com/spf13/cobra"
-	"go.uber.org/zap"
 
 	cmdcommon "postgrespro.ru/shardman/cmd"
 	"postgrespro.ru/shardman/internal/cluster"
@@ -32,6 +31,7 @@ import (
 var cfg cluster.ClusterStoreConnInfo
 var noXR bool
 var noDD bool
+var noMR bool
 var checkDeadlockIntervalRaw string
 var checkDeadlockInterval time.Duration
 var logLevel string
@@ -44,6 +44,7 @@ var shmonCmd = &cobra.Command{
   * Ensures that all replication groups are aware of current locations of other repgroups.
   * Resolves 2PC (distributed) transactions.
   * Resolves deadlocks.
+  * Saves current masters of repgroups to the store.
 Running several instances is safe.
 `,
 	PersistentPreRun: func(c *cobra.Command, args []string) {
@@ -74,6 +75,7 @@ func init() {
 	cmdcommon.AddCommonFlags(shmonCmd, &cfg, &logLevel)
 	shmonCmd.PersistentFlags().BoolVar(&noXR, "no-xact-resolver", false, "don't run xact resolver")
 	shmonCmd.PersistentFlags().BoolVar(&noDD, "no-deadlock-detector", false, "don't run deadlock detector")
+	shmonCmd.PersistentFlags().BoolVar(&noMR, "no-masters-reconciler", false, "don't save current masters to the store")
 	shmonCmd.PersistentFlags().StringVar(&checkDeadlockIntervalRaw, "deadlock-timeout", "2s", "interval between deadlock checks. Accepted formats are the same as in PostgreSQL's GUCs; default unit is ms, as in PG's deadlock_timeout")
 
 	// randomize seed
@@ -107,7 +109,6 @@ func parseDuration(raw string) (time.Duration, error) {
 type shMonState struct {
 	cs                  *cluster.ClusterStore
 	ctx                 context.Context
-	workers             map[int]chan clusterState // rgid is the key
 	xact_resolverch     chan clusterState
 	deadlock_detectorch chan clusterState
 	wg                  sync.WaitGroup
@@ -119,10 +120,7 @@ type clusterState struct {
 }
 type repGroupState struct {
 	sysId int64
-	// We need to retrieve map not finished connstr because postgres_fdw
-	// connstr can be configured only on key-value basis.
-	connstrmap map[string]string
-	// ... and connstr with single endpoint for pgx as well
+	// pgx can't into multiple hosts, so connstr with single endpoint
 	connstrSingleEP string
 }
 
@@ -132,7 +130,6 @@ func shmon(c *cobra.Command, args []string) {
 	hl = shmnlog.GetLoggerWithLevel(logLevel)
 
 	var state shMonState
-	state.workers = make(map[int]chan clusterState)
 	state.xact_resolverch = make(chan clusterState)
 	state.deadlock_detectorch = make(chan clusterState)
 
@@ -151,6 +148,12 @@ func shmon(c *cobra.Command, args []string) {
 		state.wg.Add(1)
 		go deadlockDetectorMain(ctx, state.deadlock_detectorch, &state.wg)
 	}
+	if !noMR {
+		state.wg.Add(1)
+		go mastersReconcilerMain(ctx, &state.wg)
+	}
+	state.wg.Add(1)
+	go fdwReconcilerMain(ctx, &state.wg)
 
 	// TODO: watch instead of polling
 	reloadStoreTimerCh := time.NewTimer(0).C
@@ -169,6 +172,38 @@ func shmon(c *cobra.Command, args []string) {
 	}
 }
 
+// Saves masters for use when Stolon stores are unavailable. It has its own
+// store connection, stable enough for periodic polling.
+func mastersReconcilerMain(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	mrLog := hl.With("goroutine", "masters reconciler")
+	cs, err := cluster.NewClusterStore(&cfg)
+	if err != nil {
+		mrLog.Errorf("Failed to create store: %v", err)
+		return
+	}
+	defer cs.Close()
+	mrLog.Infof("Starting")
+	cluster.NewMastersReconciler(cs, hl).Run(ctx)
+	mrLog.Infof("stopped")
+}
+
+// Keeps foreign servers pointing to current masters, see pg.FdwReconciler.
+// Like masters reconciler, it has its own store connection.
+func fdwReconcilerMain(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	frLog := hl.With("goroutine", "fdw reconciler")
+	cs, err := cluster.NewClusterStore(&cfg)
+	if err != nil {
+		frLog.Errorf("Failed to create store: %v", err)
+		return
+	}
+	defer cs.Close()
+	frLog.Infof("Starting")
+	pg.NewFdwReconciler(cs, hl).Run(ctx)
+	frLog.Infof("stopped")
+}
+
 func sigHandler(sigs chan os.Signal, cancel context.CancelFunc) {
 	s := <-sigs
 	hl.Debugf("got signal %v", s)
@@ -200,47 +235,20 @@ func reloadStore(state *shMonState) {
 		hl.Errorf("Failed to get repgroups: %v", err)
 		goto StoreError
 	}
-	// shut down workers for removed repgroups
-	for rgid, in := range state.workers {
-		if _, ok := rgs[rgid]; !ok {
-			close(in)
-			delete(state.workers, rgid)
-		}
-	}
-	// spin up workers for new repgroups
-	for rgid, _ := range rgs {
-		if _, ok := state.workers[rgid]; !ok {
-			state.wg.Add(1)
-			state.workers[rgid] = make(chan clusterState)
-			go monWorkerMain(state.ctx, rgid, state.workers[rgid], &state.wg)
-		}
-	}
-
 	// learn connstrs
 	for rgid, rg := range rgs {
-		connstrmap, _, err := state.cs.GetSuConnstrMap(state.ctx, rg, cldata, false)
-		if err != nil {
-			hl.Errorf("Failed to get connstr for rgid %d: %v", rgid, err)
-			return
-		}
-		// pgx can't into multiple hosts, so fetch connstr with single
-		// endpoint as well
 		connstrSingleEP, err := pg.GetSuConnstr(state.ctx, state.cs, rg, cldata)
 		if err != nil {
 			hl.Errorf("Failed to get single EP connstr for rgid %d: %v", rgid, err)
 			return
 		}
 		clstate.rgs[rgid] = &repGroupState{
-			connstrmap:      connstrmap,
 			connstrSingleEP: connstrSingleEP,
 			sysId:           rg.SysId,
 		}
 	}
 
-	// Send current state to all workers. They must not scribble on it.
-	for _, in := range state.workers {
-		in <- clstate
-	}
+	// Send current state to workers. They must not scribble on it.
 	if !noXR {
 		state.xact_resolverch <- clstate // push it to xact resolver also
 	}
@@ -255,178 +263,8 @@ StoreError:
 	return
 }
 
-type monWorker struct {
-	rgid    int
-	clstate clusterState
-	conn    *pgx.Conn
-	connstr string
-	// triggers retry if previous attempt failed
-	retryTimer *time.Timer
-	// not nice
-	*zap.SugaredLogger
-}
-
 const retryConnInterval = 2 * time.Second
 
-// each monworker serves one repgroup
-func monWorkerMain(ctx context.Context, rgid int, in <-chan clusterState, wg *sync.WaitGroup) {
-	defer wg.Done()
-	var w = monWorker{
-		rgid:          rgid,
-		conn:          nil,
-		retryTimer:    time.NewTimer(0),
-		SugaredLogger: hl.With("goroutine", "mon worker", "rgid", rgid),
-	}
-	<-w.retryTimer.C
-	w.Infof("Starting")
-
-	for {
-		select {
-		case <-ctx.Done():
-			if w.conn != nil {
-				w.conn.Close()
-			}
-			w.Infof("stopped")
-			return
-
-		case clstate, ok := <-in:
-			if !ok {
-				if w.conn != nil {
-					w.conn.Close()
-				}
-				w.Infof("exit")
-				return
-			}
-			w.clstate = clstate
-			// if connstr changed, invalidate connection
-			newconnstr := clstate.rgs[rgid].connstrSingleEP
-			if w.conn != nil && newconnstr != w.connstr {
-				w.conn.Close()
-				w.conn = nil
-			}
-			w.connstr = newconnstr
-			monWorkerFull(&w)
-
-		case <-w.retryTimer.C:
-			monWorkerFull(&w)
-		}
-	}
-}
-
-// actually perform full cycle: fix foreign servers
-func monWorkerFull(w *monWorker) {
-	// w.log("DEBUG: monWorkerFull")
-	var err error
-	var tx *pgx.Tx
-	if w.conn == nil {
-		connconfig, err := pgx.ParseConnectionString(w.connstr)
-		if err != nil {
-			w.Errorf("failed to parse connstr %s: %v", w.connstr, err)
-			// no point to retry until new connstr arrives
-			w.retryTimer = time.NewTimer(0)
-			<-w.retryTimer.C
-			return
-		}
-		w.conn, err = pgx.Connect(connconfig)
-		if err != nil {
-			w.Warnf("unable to connect to database: %v", err)
-			w.retryTimer = time.NewTimer(retryConnInterval)
-			return
-		}
-	}
-	tx, err = w.conn.Begin()
-	if err != nil {
-		w.Warnf("failed to begin xact: %v", err)
-		goto ConnError
-	}
-	for rgid, rg := range w.clstate.rgs {
-		if rgid == w.rgid {
-			continue
-		}
-		connstrmap := rg.connstrmap
-
-		// foreign server
-		var fs_exists bool
-		err = w.conn.QueryRow(fmt.Sprintf(
-			"select exists (select 1 from pg_foreign_server where srvname = 'hp_rg_%d')",
-			rgid)).Scan(&fs_exists)
-		if err != nil {
-			w.Warnf("failed to check fs existence: %v", err)
-			goto ConnError
-		}
-		if !fs_exists {
-			/* should never happen */
-			w.Errorf("foreign server for rgid %d doesn't exist", rgid)
-			goto ConnError
-		}
-		rows, err := w.conn.Query(fmt.Sprintf(
-			"select split_part(opt, '=', 1) k, split_part(opt, '=', 2) v from (select unnest(srvoptions) opt from pg_foreign_server where srvname = 'hp_rg_%d') o;",
-			rgid))
-		if err != nil {
-			w.Warnf("failed to retrieve fserver info: %v", err)
-			goto ConnError
-		}
-		var currfsoptsmap = make(map[string]string)
-		var key, value, currfsopts, newfsopts string
-		for rows.Next() {
-			err = rows.Scan(&key, &value)
-			if err != nil {
-				// xxx panic?
-				w.Errorf("%v", err)
-				goto ConnError
-			}
-			currfsoptsmap[key] = value
-		}
-		if rows.Err() != nil {
-			w.Errorf("%v", rows.Err())
-			goto ConnError
-		}
-		newfsopts, _ = pg.FormForeignServerOpts(connstrmap)
-		currfsopts, err = pg.FormForeignServerOpts(currfsoptsmap)
-		if err != nil || currfsopts != newfsopts {
-			/*
-			 * Need to update foreign server. We would like to avoid
-			 * recreating it to stay away from rebuilding foreign
-			 * tables and user mappings.
-			 */
-			w.Infof("altering foreign server to rg %d", rgid)
-			/* drop all currents opts */
-			for optname, _ := range currfsoptsmap {
-				_, err = w.conn.Exec(fmt.Sprintf(
-					"alter server hp_rg_%d options (drop %s)",
-					rgid, optname))
-				if err != nil {
-					w.Warnf("failed to drop fs opts: %v", err)
-					goto ConnError
-				}
-			}
-			/* add all new opts */
-			_, err = w.conn.Exec(fmt.Sprintf(
-				"alter server hp_rg_%d %s", rgid, newfsopts))
-			if err != nil {
-				w.Warnf("failed to set new fs opts: %v", err)
-				goto ConnError
-			}
-		}
-	}
-	err = tx.Commit()
-	if err != nil {
-		w.Warnf("failed to commit xact: %v", err)
-		goto ConnError
-	}
-
-	// all is ok, defuse timer
-	// recommended "if !t.Stop() { <-t }" doesn't work because if timer
-	// was previously stopped, we hang in <-t
-	w.retryTimer = time.NewTimer(0)
-	<-w.retryTimer.C
-	return
-ConnError:
-	w.conn.Close()
-	w.conn = nil
-	w.retryTimer = time.NewTimer(retryConnInterval)
-}
-
 type xResolveRequest struct {
 	requester int // requester rgid
 	gid       string
@@ -0,0 +1,59 @@
+// Copyright (c) 2019, Postgres Professional
+
+package cmd
+
+import (
+	"context"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"postgrespro.ru/shardman/internal/cluster"
+	"postgrespro.ru/shardman/internal/cluster/commands"
+)
+
+// for args
+var manifestFile string
+var dryRun bool
+
+var applyCmd = &cobra.Command{
+	Use:   "apply",
+	Run:   apply,
+	Short: "Reconcile the cluster towards declarative manifest (YAML or JSON) with Spec, RepGroups and Tables sections. Omitted sections are not touched.",
+	PreRun: func(c *cobra.Command, args []string) {
+		if manifestFile == "" {
+			hl.Fatalf("manifest file is required")
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(applyCmd)
+
+	applyCmd.Flags().StringVarP(&manifestFile, "file", "f", "", "manifest file; if '-', read from stdin")
+	applyCmd.Flags().BoolVar(&dryRun, "dry-run", false, "only print what would be done")
+}
+
+func apply(cmd *cobra.Command, args []string) {
+	cs, err := cluster.NewClusterStore(&cfg)
+	if err != nil {
+		hl.Fatalf("failed to create store: %v", err)
+	}
+	defer cs.Close()
+
+	var r io.Reader = os.Stdin
+	if manifestFile != "-" {
+		f, err := os.Open(manifestFile)
+		if err != nil {
+			hl.Fatalf("cannot read file: %v", err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	err = commands.ApplyManifest(context.Background(), hl, cs, &cfg.StoreConnInfo, r, dryRun)
+	if err != nil {
+		hl.Fatalf("apply failed: %v", err)
+	}
+}
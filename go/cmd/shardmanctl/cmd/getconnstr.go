@@ -48,7 +48,9 @@ func getConnstr(cmd *cobra.Command, args []string) {
 	rgs, _, err := cs.GetRepGroups(context.TODO())
 	if err != nil {
 		hl.Fatalf("Failed to get repgroups: %v", err)
-	} else if len(rgs) == 0 {
+	}
+	rgs = cluster.ReadyRepGroups(rgs)
+	if len(rgs) == 0 {
 		hl.Fatalf("Please add at least one repgroup")
 	}
 
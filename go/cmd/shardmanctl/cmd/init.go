@@ -13,6 +13,7 @@ import (
 
 	"postgrespro.ru/shardman/internal/cluster"
 	"postgrespro.ru/shardman/internal/cluster/commands"
+	"postgrespro.ru/shardman/internal/store"
 )
 
 var specFile string
@@ -77,7 +78,7 @@ func initCluster(cmd *cobra.Command, args []string) {
 	if err := json.Unmarshal(specdata, &spec); err != nil {
 		log.Fatalf("failed to unmarshal cluster spec: %v", err)
 	}
-	err = commands.InitCluster(context.TODO(), cs, &spec)
+	err = commands.InitCluster(store.WithMetricsLabel(context.TODO(), "bootstrap"), cs, &spec)
 	if err != nil {
 		log.Fatalf("%v", err)
 	}
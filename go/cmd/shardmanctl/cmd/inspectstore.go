@@ -0,0 +1,39 @@
+// Copyright (c) 2019, Postgres Professional
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"postgrespro.ru/shardman/internal/cluster"
+)
+
+var inspectStoreCmd = &cobra.Command{
+	Use:   "inspect-store",
+	Run:   inspectStore,
+	Short: "List all keys of the cluster in the store with value sizes and revisions. Low-level debugging aid.",
+}
+
+func init() {
+	rootCmd.AddCommand(inspectStoreCmd)
+}
+
+func inspectStore(cmd *cobra.Command, args []string) {
+	cs, err := cluster.NewClusterStore(&cfg)
+	if err != nil {
+		hl.Fatalf("failed to create store: %v", err)
+	}
+	defer cs.Close()
+
+	infos, err := cs.InspectKeys(context.TODO())
+	if err != nil {
+		hl.Fatalf("failed to inspect store: %v", err)
+	}
+	fmt.Printf("%-40s %10s %12s %12s\n", "KEY", "SIZE", "MODREV", "CREATEREV")
+	for _, info := range infos {
+		fmt.Printf("%-40s %10d %12d %12d\n", info.Key, info.Size, info.ModRevision, info.CreateRevision)
+	}
+}
@@ -9,12 +9,16 @@ import (
 
 	"github.com/spf13/cobra"
 	"postgrespro.ru/shardman/internal/cluster"
+	"postgrespro.ru/shardman/internal/store"
 )
 
 // store args here
 type updateOptsT struct {
-	patch bool
-	file  string
+	patch            bool
+	file             string
+	meta             cluster.ChangeMeta
+	expectedRevision uint64
+	preflight        string
 }
 
 var updateOpts updateOptsT
@@ -30,6 +34,11 @@ func init() {
 	rootCmd.AddCommand(updateSpecCmd)
 	updateSpecCmd.PersistentFlags().BoolVarP(&updateOpts.patch, "patch", "p", false, "patch the current cluster specification instead of replacing it")
 	updateSpecCmd.PersistentFlags().StringVarP(&updateOpts.file, "file", "f", "", "file containing a complete cluster specification or a patch to apply to the current cluster specification. if '-', read from stdin")
+	updateSpecCmd.PersistentFlags().StringVar(&updateOpts.meta.Actor, "actor", "", "who performs the change, recorded in spec history")
+	updateSpecCmd.PersistentFlags().StringVar(&updateOpts.meta.Reason, "reason", "", "why the change is performed, recorded in spec history")
+	updateSpecCmd.PersistentFlags().StringVar(&updateOpts.meta.Ticket, "ticket", "", "ticket ID of the change, recorded in spec history")
+	updateSpecCmd.PersistentFlags().Uint64Var(&updateOpts.expectedRevision, "expected-revision", 0, "update only if cluster data still has this store revision")
+	updateSpecCmd.PersistentFlags().StringVar(&updateOpts.preflight, "preflight", "none", "before updating, check that Stolon stores of all repgroups are reachable (store) and that all repgroups have healthy master (master); if any check fails, nothing is changed. none|store|master")
 }
 
 func update(cmd *cobra.Command, args []string) {
@@ -58,12 +67,21 @@ func update(cmd *cobra.Command, args []string) {
 		}
 	}
 
+	preflight, err := cluster.ParsePreflight(updateOpts.preflight)
+	if err != nil {
+		hl.Fatalf("%v", err)
+	}
+
 	cs, err := cluster.NewClusterStore(&cfg)
 	if err != nil {
 		hl.Fatalf("failed to create store: %v", err)
 	}
 	defer cs.Close()
-	err = cs.UpdateStolonSpec(context.TODO(), &cfg.StoreConnInfo, data, updateOpts.patch)
+	ctx := store.WithMetricsLabel(context.TODO(), "update")
+	if updateOpts.meta != (cluster.ChangeMeta{}) {
+		ctx = cluster.WithChangeMeta(ctx, &updateOpts.meta)
+	}
+	err = cs.UpdateStolonSpec(ctx, &cfg.StoreConnInfo, data, updateOpts.patch, updateOpts.expectedRevision, preflight)
 	if err != nil {
 		hl.Fatalf("failed to update the spec: %v", err)
 	}
@@ -1,25 +1,48 @@
 module postgrespro.ru/shardman
 
+go 1.27.1
+
 require (
-	github.com/coreos/etcd v3.3.10+incompatible // indirect
 	github.com/coreos/go-systemd v0.0.0-20181031085051-9002847aa142
 	github.com/davecgh/go-spew v1.1.1
-	github.com/ghodss/yaml v1.0.0 // indirect
+	github.com/ghodss/yaml v1.0.0
+	github.com/jackc/pgx v3.2.0+incompatible
+	github.com/spf13/cobra v0.0.3
+	github.com/spf13/pflag v1.0.3
+	go.etcd.io/etcd v3.3.10+incompatible
+	go.uber.org/zap v1.9.1
+	google.golang.org/grpc v1.16.0
+	k8s.io/apimachinery v0.0.0-20181101131016-0aa9751e8aaf
+)
+
+require (
+	cloud.google.com/go v0.26.0 // indirect
+	github.com/client9/misspell v0.3.4 // indirect
+	github.com/coreos/etcd v3.3.10+incompatible // indirect
 	github.com/godbus/dbus v0.0.0-20181025153459-66d97aec3384 // indirect
 	github.com/gogo/protobuf v1.1.1 // indirect
+	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b // indirect
+	github.com/golang/lint v0.0.0-20180702182130-06c8688daad7 // indirect
+	github.com/golang/mock v1.1.1 // indirect
+	github.com/golang/protobuf v1.2.0 // indirect
 	github.com/google/gofuzz v0.0.0-20170612174753-24818f796faf // indirect
 	github.com/googleapis/gnostic v0.2.0 // indirect
-	github.com/jackc/pgx v3.2.0+incompatible
+	github.com/kisielk/gotool v1.0.0 // indirect
 	github.com/pkg/errors v0.8.0 // indirect
-	github.com/spf13/cobra v0.0.3
-	github.com/spf13/pflag v1.0.3
-	go.etcd.io/etcd v3.3.10+incompatible
 	go.uber.org/atomic v1.3.2 // indirect
 	go.uber.org/multierr v1.1.0 // indirect
-	go.uber.org/zap v1.9.1
-	google.golang.org/grpc v1.16.0 // indirect
+	golang.org/x/lint v0.0.0-20180702182130-06c8688daad7 // indirect
+	golang.org/x/net v0.0.0-20180826012351-8a410e7b638d // indirect
+	golang.org/x/oauth2 v0.0.0-20180821212333-d2e6202438be // indirect
+	golang.org/x/sync v0.0.0-20180314180146-1d60e4601c6f // indirect
+	golang.org/x/sys v0.0.0-20180830151530-49385e6e1522 // indirect
+	golang.org/x/text v0.3.0 // indirect
+	golang.org/x/tools v0.0.0-20180828015842-6cd1fcedba52 // indirect
+	google.golang.org/appengine v1.1.0 // indirect
+	google.golang.org/genproto v0.0.0-20180817151627-c66870c02cf8 // indirect
+	gopkg.in/check.v1 v0.0.0-20161208181325-20d25e280405 // indirect
 	gopkg.in/inf.v0 v0.9.1 // indirect
 	gopkg.in/yaml.v2 v2.2.1 // indirect
-	k8s.io/apimachinery v0.0.0-20181101131016-0aa9751e8aaf
+	honnef.co/go/tools v0.0.0-20180728063816-88497007e858 // indirect
 	k8s.io/kube-openapi v0.0.0-20181031203759-72693cb1fadd // indirect
 )
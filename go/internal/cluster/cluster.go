@@ -29,8 +29,37 @@ type ClusterSpec struct {
 	// if needed.
 	UseProxy   bool
 	StolonSpec StolonSpec
+	// How partitions of new tables are distributed among repgroups, see
+	// PlacementStrategy* constants. Empty means round robin.
+	PlacementStrategy string
+	// Repgroup serving as well-known entry point for distributed queries,
+	// see GetCoordinatorConnstrMap. 0 means repgroup with the lowest rgid.
+	CoordinatorRgid int
+	// libpq options added to su connstrs, see ConnDefaults
+	ConnDefaults ConnDefaults
 }
 
+// Environment-wide defaults of su connstrs built by GetSuConnstrMap* and
+// GetReplicaConnstrMap. Precedence, from lowest: ConnDefaults, then
+// RepGroup.ExtraConnOptions, then options shardman sets itself (host, port,
+// user, password, dbname), which can't be overridden. Shardman's own
+// connections (pgx) use only options pgx supports, see pg.PgxConnstrMap; the
+// rest apply to libpq clients such as postgres_fdw and psql.
+type ConnDefaults struct {
+	ConnectTimeout  int    // seconds; 0 means libpq default
+	SSLMode         string // e.g. require
+	ApplicationName string
+	// other libpq options
+	Options map[string]string
+}
+
+const (
+	// each repgroup gets the same number of partitions (+-1)
+	PlacementStrategyRoundRobin = "roundrobin"
+	// repgroup gets number of partitions proportional to its Weight
+	PlacementStrategyWeighted = "weighted"
+)
+
 // Replication group ~ Stolon instance.
 type RepGroup struct {
 	StolonName string
@@ -38,6 +67,24 @@ type RepGroup struct {
 	StoreConnInfo StoreConnInfo
 	StorePrefix   string
 	SysId         int64
+	// relative capacity of the repgroup for weighted placement; 0 means 1
+	Weight int
+	// keeper uid -> relative share of read load its standby gets in
+	// GetReplicaConnstrMap; not listed keepers get 1, 0 excludes keeper
+	ReplicaWeights map[string]int
+	// registered, but not ready for work yet, see AddRepGroupPending;
+	// connstr and placement helpers skip such repgroups
+	Pending bool `json:",omitempty"`
+	// libpq options added to su connstrs of this repgroup, overriding
+	// ClusterSpec.ConnDefaults
+	ExtraConnOptions map[string]string
+}
+
+// Current master of repgroup as seen by shardman, saved under masters key
+type Master struct {
+	Address  string
+	Port     string
+	Priority int
 }
 
 // Sharded tables
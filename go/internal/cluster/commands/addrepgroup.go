@@ -61,15 +61,30 @@ func AddRepGroup(ctx context.Context, hl *shmnlog.Logger, cs *cluster.ClusterSto
 		return fmt.Errorf("Failed to get repgroups: %v", err)
 	}
 	var newrgid int = 0
+	var resumed = false
 	for rgid, rg := range rgs {
 		if rg.SysId == newrg.SysId {
-			return fmt.Errorf("Repgroup with sys id %v already exists", rg.SysId)
+			if !rg.Pending {
+				return fmt.Errorf("Repgroup with sys id %v already exists", rg.SysId)
+			}
+			// previous attempt failed midway, redo it under the same rgid
+			newrgid = rgid
+			resumed = true
+			break
 		}
 		if rgid > newrgid {
 			newrgid = rgid
 		}
 	}
-	newrgid++
+	if !resumed {
+		newrgid++
+		// reserve rgid; until marked ready, the repgroup is not used by
+		// the rest of shardman
+		if err = cs.AddRepGroupPending(ctx, newrgid, newrg); err != nil {
+			return fmt.Errorf("failed to register pending repgroup: %v", err)
+		}
+	}
+	rgs = cluster.ReadyRepGroups(rgs)
 
 	// stamp rgid in config
 	err = cluster.StolonUpdate(hpc, newrg, newrgid, true, &cldata.Spec.StolonSpec)
@@ -224,10 +239,9 @@ func AddRepGroup(ctx context.Context, hl *shmnlog.Logger, cs *cluster.ClusterSto
 		return fmt.Errorf("bcst failed: %v", err)
 	}
 
-	// TODO make atomic
-	err = cs.PutRepGroups(context.TODO(), rgs)
+	err = cs.MarkRepGroupReady(ctx, newrgid)
 	if err != nil {
-		return fmt.Errorf("failed to save repgroup data in store: %v", err)
+		return fmt.Errorf("failed to mark repgroup ready: %v", err)
 	}
 
 	return nil
@@ -0,0 +1,102 @@
+// Copyright (c) 2019, Postgres Professional
+
+package commands
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"postgrespro.ru/shardman/internal/cluster"
+	"postgrespro.ru/shardman/internal/pg"
+	"postgrespro.ru/shardman/internal/shmnlog"
+)
+
+// Execute rebalance plan (see pg.GenerateRebalancePlan) moving up to p
+// partitions simultaneously. Each move updates placement metadata in its own
+// transaction, and progress is recorded in the store, so if applying was
+// interrupted, calling this again with the same plan (or nil plan) resumes
+// it. progressCb, if not nil, is called after each finished move with number
+// of moves done so far.
+func ApplyRebalancePlan(ctx context.Context, hl *shmnlog.Logger, cs *cluster.ClusterStore, p int, plan []cluster.PartitionMove, progressCb func(done int, total int, move cluster.PartitionMove)) error {
+	progress, err := cs.GetRebalanceProgress(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get rebalance progress: %v", err)
+	}
+	if plan == nil {
+		if progress == nil {
+			return fmt.Errorf("no interrupted rebalance to resume")
+		}
+		plan = progress.Plan
+	}
+	if progress == nil || !reflect.DeepEqual(progress.Plan, plan) || len(progress.Done) != len(plan) {
+		if progress != nil {
+			hl.Warnf("discarding progress of another interrupted rebalance plan")
+		}
+		progress = &cluster.RebalanceProgress{Plan: plan, Done: make([]bool, len(plan))}
+	}
+
+	// progress save might have failed after the move was committed, so
+	// trust the metadata as well
+	tables, err := pg.GetTables(cs, ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get sharded tables: %v", err)
+	}
+	var placement = make(map[string][]int)
+	for _, t := range tables {
+		placement[t.Schema+"."+t.Relname] = t.Partmap
+	}
+	var ndone = 0
+	var tasks = make([]MoveTask, 0)
+	for i, move := range plan {
+		partmap, ok := placement[move.Schema+"."+move.Relname]
+		if !ok || move.Pnum < 0 || move.Pnum >= len(partmap) {
+			return fmt.Errorf("partition %d of table %s.%s not found", move.Pnum, move.Schema, move.Relname)
+		}
+		if !progress.Done[i] && partmap[move.Pnum] == move.ToRgid {
+			progress.Done[i] = true
+		}
+		if progress.Done[i] {
+			ndone++
+			continue
+		}
+		if partmap[move.Pnum] != move.FromRgid {
+			return fmt.Errorf("partition %d of table %s.%s is on repgroup %d, not %d; plan is outdated",
+				move.Pnum, move.Schema, move.Relname, partmap[move.Pnum], move.FromRgid)
+		}
+		// tasks are taken from the tail
+		tasks = append([]MoveTask{{
+			SrcRgid:   move.FromRgid,
+			DstRgid:   move.ToRgid,
+			Schema:    move.Schema,
+			TableName: move.Relname,
+			Pnum:      move.Pnum,
+			planIdx:   i,
+		}}, tasks...)
+	}
+	if ndone != 0 {
+		hl.Infof("resuming rebalance, %d of %d moves already done", ndone, len(plan))
+	}
+	if err = cs.PutRebalanceProgress(ctx, progress); err != nil {
+		return fmt.Errorf("failed to save rebalance progress: %v", err)
+	}
+
+	err = rebalance(ctx, hl, cs, p, tasks, func(task MoveTask) error {
+		progress.Done[task.planIdx] = true
+		ndone++
+		if err := cs.PutRebalanceProgress(ctx, progress); err != nil {
+			return fmt.Errorf("failed to save rebalance progress: %v", err)
+		}
+		if progressCb != nil {
+			progressCb(ndone, len(plan), plan[task.planIdx])
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err = cs.PutRebalanceProgress(ctx, nil); err != nil {
+		return fmt.Errorf("failed to clear rebalance progress: %v", err)
+	}
+	return nil
+}
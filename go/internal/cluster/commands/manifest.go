@@ -0,0 +1,290 @@
+// Copyright (c) 2019, Postgres Professional
+
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/ghodss/yaml"
+	"github.com/jackc/pgx"
+
+	"postgrespro.ru/shardman/internal/cluster"
+	"postgrespro.ru/shardman/internal/pg"
+	"postgrespro.ru/shardman/internal/shmnlog"
+	"postgrespro.ru/shardman/internal/store"
+)
+
+// Desired state of the cluster. Omitted (null) sections are left as is.
+type Manifest struct {
+	// Complete cluster spec; defaults are filled as in init
+	Spec *cluster.ClusterSpec
+	// Repgroups are identified by StolonName
+	RepGroups []cluster.RepGroup
+	// Tables which must be sharded; Partmap is ignored
+	Tables []cluster.Table
+}
+
+type manifestStep struct {
+	descr string
+	apply func() error // nil if step can't be performed automatically
+}
+
+// Reconcile the cluster towards manifest read from r (YAML or JSON). If dryRun
+// is true, just log the plan. Repgroups present in the manifest but not in the
+// cluster are added, and vice versa; tables are sharded with
+// shardman.hash_shard_table, they must already exist. Changes which can't be
+// done automatically (e.g. changing Nparts of sharded table or store conn
+// info of existing repgroup) are reported and make the apply fail before
+// anything is changed.
+func ApplyManifest(ctx context.Context, hl *shmnlog.Logger, cs *cluster.ClusterStore, hpc *cluster.StoreConnInfo, r io.Reader, dryRun bool) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("failed to read manifest: %v", err)
+	}
+	var m Manifest
+	if err = yaml.Unmarshal(data, &m); err != nil {
+		return fmt.Errorf("failed to parse manifest: %v", err)
+	}
+
+	steps, err := planManifest(ctx, hl, cs, hpc, &m)
+	if err != nil {
+		return err
+	}
+	if len(steps) == 0 {
+		hl.Infof("cluster matches the manifest, nothing to do")
+		return nil
+	}
+	var manual = 0
+	for i, step := range steps {
+		if step.apply == nil {
+			hl.Infof("step %d: %s (must be done manually)", i+1, step.descr)
+			manual++
+		} else {
+			hl.Infof("step %d: %s", i+1, step.descr)
+		}
+	}
+	if dryRun {
+		return nil
+	}
+	if manual != 0 {
+		return fmt.Errorf("%d steps can't be performed automatically, nothing applied", manual)
+	}
+
+	for i, step := range steps {
+		hl.Infof("applying step %d: %s", i+1, step.descr)
+		if err = step.apply(); err != nil {
+			return fmt.Errorf("step %d (%s) failed: %v", i+1, step.descr, err)
+		}
+	}
+	return nil
+}
+
+func planManifest(ctx context.Context, hl *shmnlog.Logger, cs *cluster.ClusterStore, hpc *cluster.StoreConnInfo, m *Manifest) ([]manifestStep, error) {
+	var steps = make([]manifestStep, 0)
+
+	cldata, cldataPair, err := cs.GetClusterData(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get cluster data: %v", err)
+	}
+	if cldata == nil {
+		return nil, fmt.Errorf("cluster data not found, init the cluster first")
+	}
+
+	// spec
+	if m.Spec != nil {
+		newspec := *m.Spec
+		adjustSpecDefaults(&newspec)
+		if err := validateSpec(&newspec); err != nil {
+			return nil, fmt.Errorf("spec validation failed: %v", err)
+		}
+
+		currstolonj, _ := json.Marshal(cldata.Spec.StolonSpec)
+		newstolonj, err := json.Marshal(newspec.StolonSpec)
+		if err != nil {
+			return nil, err
+		}
+		var stolonChanged = !bytes.Equal(currstolonj, newstolonj)
+		if stolonChanged {
+			steps = append(steps, manifestStep{
+				descr: "update Stolon spec",
+				apply: func() error {
+					// fail if spec changed since planning
+					return cs.UpdateStolonSpec(ctx, hpc, newstolonj, false, cldataPair.LastIndex, cluster.PreflightStore)
+				},
+			})
+		}
+
+		// the rest of spec
+		var currrest, newrest = cldata.Spec, newspec
+		currrest.StolonSpec, newrest.StolonSpec = cluster.StolonSpec{}, cluster.StolonSpec{}
+		currrestj, _ := json.Marshal(currrest)
+		newrestj, _ := json.Marshal(newrest)
+		if !bytes.Equal(currrestj, newrestj) {
+			steps = append(steps, manifestStep{
+				descr: "update cluster spec",
+				apply: func() error {
+					var cur, pair = cldata, cldataPair
+					var err error
+					if stolonChanged {
+						// previous step has just saved cluster data,
+						// having checked it wasn't modified since
+						// planning; make sure nobody sneaked in after
+						cur, pair, err = cs.GetClusterData(ctx)
+						if err != nil {
+							return err
+						}
+						if cur == nil {
+							return fmt.Errorf("cluster data not found")
+						}
+						var rest = cur.Spec
+						rest.StolonSpec = cluster.StolonSpec{}
+						restj, _ := json.Marshal(rest)
+						if !bytes.Equal(restj, currrestj) {
+							return fmt.Errorf("cluster spec was modified concurrently, retry")
+						}
+					}
+					var upd = *cur
+					newrest.StolonSpec = cur.Spec.StolonSpec
+					upd.Spec = newrest
+					err = cs.AtomicPutClusterData(ctx, &upd, pair)
+					if err == store.ErrKeyModified {
+						return fmt.Errorf("cluster data was modified concurrently, retry")
+					}
+					return err
+				},
+			})
+		}
+	}
+
+	// repgroups
+	rgs, _, err := cs.GetRepGroups(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get repgroups: %v", err)
+	}
+	if m.RepGroups != nil {
+		var existing = make(map[string]*cluster.RepGroup)
+		for _, rg := range rgs {
+			existing[rg.StolonName] = rg
+		}
+		var wanted = make(map[string]bool)
+		for i, _ := range m.RepGroups {
+			newrg := m.RepGroups[i]
+			if newrg.StolonName == "" {
+				return nil, fmt.Errorf("repgroup without StolonName in manifest")
+			}
+			if newrg.StorePrefix == "" {
+				newrg.StorePrefix = "stolon/cluster"
+			}
+			wanted[newrg.StolonName] = true
+			if rg, ok := existing[newrg.StolonName]; ok {
+				if rg.StoreConnInfo != newrg.StoreConnInfo || rg.StorePrefix != newrg.StorePrefix {
+					steps = append(steps, manifestStep{
+						descr: fmt.Sprintf("change store conn info of repgroup %s", newrg.StolonName),
+					})
+				}
+				continue
+			}
+			steps = append(steps, manifestStep{
+				descr: fmt.Sprintf("add repgroup %s", newrg.StolonName),
+				apply: func() error {
+					return AddRepGroup(ctx, hl, cs, hpc, &newrg)
+				},
+			})
+		}
+		for name, _ := range existing {
+			if wanted[name] {
+				continue
+			}
+			rmname := name
+			steps = append(steps, manifestStep{
+				descr: fmt.Sprintf("remove repgroup %s", rmname),
+				apply: func() error {
+					return RmRepGroup(ctx, hl, cs, rmname)
+				},
+			})
+		}
+	}
+
+	// tables
+	if len(m.Tables) != 0 {
+		var tables []cluster.Table
+		if len(rgs) != 0 {
+			tables, err = pg.GetTables(cs, ctx)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to retrieve tables: %v", err)
+			}
+		}
+		var sharded = make(map[string]cluster.Table)
+		for _, t := range tables {
+			sharded[fmt.Sprintf("%s.%s", pg.QI(t.Schema), pg.QI(t.Relname))] = t
+		}
+		for _, t := range m.Tables {
+			if t.Schema == "" {
+				t.Schema = "public"
+			}
+			relname := fmt.Sprintf("%s.%s", pg.QI(t.Schema), pg.QI(t.Relname))
+			if st, ok := sharded[relname]; ok {
+				if st.Nparts != t.Nparts || st.ColocateWithSchema != t.ColocateWithSchema ||
+					st.ColocateWithRelname != t.ColocateWithRelname {
+					steps = append(steps, manifestStep{
+						descr: fmt.Sprintf("change partitioning of already sharded table %s", relname),
+					})
+				}
+				continue
+			}
+			colocate := "null"
+			if t.ColocateWithRelname != "" {
+				if t.ColocateWithSchema == "" {
+					t.ColocateWithSchema = "public"
+				}
+				colocate = fmt.Sprintf("%s::regclass", pg.QL(fmt.Sprintf("%s.%s",
+					pg.QI(t.ColocateWithSchema), pg.QI(t.ColocateWithRelname))))
+			}
+			sql := fmt.Sprintf("select shardman.hash_shard_table(%s::regclass, %d, %s)",
+				pg.QL(relname), t.Nparts, colocate)
+			steps = append(steps, manifestStep{
+				descr: fmt.Sprintf("shard table %s into %d partitions", relname, t.Nparts),
+				apply: func() error {
+					return execOnAnyRepGroup(ctx, cs, sql)
+				},
+			})
+		}
+	}
+
+	return steps, nil
+}
+
+// run sql on some repgroup, e.g. broadcasting stuff of shardman extension
+func execOnAnyRepGroup(ctx context.Context, cs *cluster.ClusterStore, sql string) error {
+	cldata, _, err := cs.GetClusterData(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot get cluster data: %v", err)
+	}
+	rgs, _, err := cs.GetRepGroups(ctx)
+	if err != nil {
+		return fmt.Errorf("Failed to get repgroups: %v", err)
+	}
+	for _, rg := range rgs {
+		connstr, err := pg.GetSuConnstr(ctx, cs, rg, cldata)
+		if err != nil {
+			return fmt.Errorf("failed to get connstr: %v", err)
+		}
+		connconfig, err := pgx.ParseConnectionString(connstr)
+		if err != nil {
+			return fmt.Errorf("connstring parsing \"%s\" failed: %v", connstr, err)
+		}
+		conn, err := pgx.Connect(connconfig)
+		if err != nil {
+			return fmt.Errorf("Unable to connect to database: %v", err)
+		}
+		defer conn.Close()
+		_, err = conn.Exec(sql)
+		return err
+	}
+	return fmt.Errorf("no repgroups in cluster")
+}
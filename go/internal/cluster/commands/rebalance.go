@@ -26,6 +26,7 @@ type MoveTask struct {
 	Schema     string
 	TableName  string
 	Pnum       int
+	planIdx    int // index in applied plan, see ApplyRebalancePlan
 }
 
 func min(x, y int) int {
@@ -46,8 +47,9 @@ type commitRequest struct {
 }
 
 type report struct {
-	err error // nil ~ ok
-	id  int
+	err  error // nil ~ ok
+	id   int
+	task MoveTask // finished task
 }
 
 // movepart worker state machine
@@ -284,15 +286,14 @@ func movePartWorkerMain(hl *shmnlog.Logger, in <-chan MoveTask, out chan<- repor
 				// otherwise we might crash and lost partition.
 				// src partition is also dropped here
 				state = movePartWorkerCommitting
-				_, err = dst_conn.Exec(fmt.Sprintf("select shardman.part_moved(%s::regclass, %d, %d, %d);",
-					pg.QL(pg.QI(task.TableName)), task.Pnum, task.SrcRgid, task.DstRgid))
+				err = pg.CommitPartitionMove(dst_conn, task.TableName, task.Pnum, task.SrcRgid, task.DstRgid)
 				if err != nil {
 					rwLog.Errorf("failed to commit partmove: %v", err)
 					goto ERRTMT
 				}
 
 				/* done */
-				out <- report{err: nil, id: myid}
+				out <- report{err: nil, id: myid, task: task}
 				state = movePartWorkerIdle
 				continue
 			}
@@ -310,6 +311,12 @@ func movePartWorkerMain(hl *shmnlog.Logger, in <-chan MoveTask, out chan<- repor
 }
 
 func Rebalance(ctx context.Context, hl *shmnlog.Logger, cs *cluster.ClusterStore, p int, tasks []MoveTask) error {
+	return rebalance(ctx, hl, cs, p, tasks, nil)
+}
+
+// onDone, if not nil, is called (from this goroutine) after each successfully
+// moved partition
+func rebalance(ctx context.Context, hl *shmnlog.Logger, cs *cluster.ClusterStore, p int, tasks []MoveTask, onDone func(MoveTask) error) error {
 	// fill connstrs
 	connstrs, err := pg.GetSuConnstrs(ctx, cs)
 	if err != nil {
@@ -342,6 +349,9 @@ func Rebalance(ctx context.Context, hl *shmnlog.Logger, cs *cluster.ClusterStore
 	for active_workers != 0 {
 		select {
 		case report := <-reportch:
+			if report.err == nil && onDone != nil {
+				report.err = onDone(report.task)
+			}
 			if report.err != nil {
 				err = report.err
 				// not much sense to continue after any error
@@ -0,0 +1,45 @@
+// Copyright (c) 2019, Postgres Professional
+
+package cluster
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// libpq connection keywords, up to PG 16
+var libpqKeywords = map[string]bool{
+	"host": true, "hostaddr": true, "port": true, "dbname": true, "user": true,
+	"password": true, "passfile": true, "channel_binding": true,
+	"connect_timeout": true, "client_encoding": true, "options": true,
+	"application_name": true, "fallback_application_name": true,
+	"keepalives": true, "keepalives_idle": true, "keepalives_interval": true,
+	"keepalives_count": true, "tcp_user_timeout": true, "tty": true,
+	"replication": true, "gssencmode": true, "sslmode": true,
+	"requiressl": true, "sslcompression": true, "sslcert": true,
+	"sslkey": true, "sslpassword": true, "sslcertmode": true,
+	"sslrootcert": true, "sslcrl": true, "sslcrldir": true, "sslsni": true,
+	"requirepeer": true, "require_auth": true, "ssl_min_protocol_version": true,
+	"ssl_max_protocol_version": true, "krbsrvname": true, "gsslib": true,
+	"gssdelegation": true, "service": true, "target_session_attrs": true,
+	"load_balance_hosts": true,
+}
+
+// Check that all keys of connstr map are libpq connection keywords, catching
+// typos like sslmdoe. Maps are validated against libpq since they are also
+// handed to libpq clients (postgres_fdw, psql, env); shardman's own pgx
+// connections drop options pgx doesn't support, see pg.PgxConnstrMap.
+func ValidateConnOptions(opts map[string]string) error {
+	var unknown = make([]string, 0)
+	for opt, _ := range opts {
+		if !libpqKeywords[opt] {
+			unknown = append(unknown, opt)
+		}
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+	sort.Strings(unknown)
+	return fmt.Errorf("unknown libpq connection options: %s", strings.Join(unknown, ", "))
+}
@@ -0,0 +1,47 @@
+// Copyright (c) 2019, Postgres Professional
+
+package cluster
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateConnOptions(t *testing.T) {
+	var tests = []struct {
+		name    string
+		opts    map[string]string
+		unknown string // expected in error; "" if valid
+	}{
+		{"empty", map[string]string{}, ""},
+		{"core", map[string]string{"host": "10.0.0.1", "port": "5432", "user": "postgres", "dbname": "postgres"}, ""},
+		{"libpq only", map[string]string{"keepalives_idle": "30", "target_session_attrs": "read-write"}, ""},
+		{"typo", map[string]string{"host": "10.0.0.1", "sslmdoe": "require"}, "sslmdoe"},
+		{"several", map[string]string{"sslmdoe": "require", "aplication_name": "x"}, "aplication_name, sslmdoe"},
+		{"guc", map[string]string{"search_path": "public"}, "search_path"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateConnOptions(tt.opts)
+			if tt.unknown == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.unknown) {
+				t.Errorf("expected error mentioning %s, got %v", tt.unknown, err)
+			}
+		})
+	}
+}
+
+// typo in ConnDefaults ends up in su connstr map and is caught there
+func TestSuConnstrMapValidation(t *testing.T) {
+	cldata := &ClusterData{Spec: ClusterSpec{PgSuUsername: "postgres", PgSuAuthMethod: "trust",
+		ConnDefaults: ConnDefaults{SSLMode: "require", Options: map[string]string{"sslmdoe": "disable"}}}}
+	cp := suConnstrMap(cldata, &RepGroup{}, &Endpoint{Address: "10.0.0.1", Port: "5432"})
+	if err := ValidateConnOptions(cp); err == nil {
+		t.Errorf("expected sslmdoe from ConnDefaults to be rejected")
+	}
+}
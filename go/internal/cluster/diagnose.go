@@ -0,0 +1,195 @@
+// Copyright (c) 2019, Postgres Professional
+
+// step-by-step store connection check for setup debugging
+package cluster
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.etcd.io/etcd/etcdserver/api/v3rpc/rpctypes"
+
+	tlswrap "postgrespro.ru/shardman/internal/tls"
+)
+
+// Stages of store connection, in order
+const (
+	DiagnosisStageConfig = "config" // parsing endpoints, loading TLS files
+	DiagnosisStageDNS    = "dns"
+	DiagnosisStageTCP    = "tcp"
+	DiagnosisStageTLS    = "tls" // handshake, https endpoints only
+	DiagnosisStageAuth   = "auth"
+	DiagnosisStageGet    = "get" // test read of cluster data
+)
+
+// Result of checking single endpoint; empty errors mean success
+type EndpointDiagnosis struct {
+	Endpoint string
+	Addrs    []string // resolved
+	DNSError string
+	TCPError string
+	TLSError string // "" also if TLS is not used
+}
+
+type Diagnosis struct {
+	Endpoints []EndpointDiagnosis
+	// first stage which failed for all endpoints, for auth or get as a
+	// whole; "" if everything is fine
+	FailedStage string
+	Error       string // of FailedStage
+	// cluster data is present
+	ClusterFound bool
+}
+
+func (d *Diagnosis) fail(stage string, err error) *Diagnosis {
+	if d.FailedStage == "" {
+		d.FailedStage = stage
+		d.Error = err.Error()
+	}
+	return d
+}
+
+// Connect to the store described by cfg stage by stage and report where it
+// breaks. error is returned only if ctx is done.
+func DiagnoseStore(ctx context.Context, cfg *ClusterStoreConnInfo) (*Diagnosis, error) {
+	var d = &Diagnosis{}
+	var timeout = time.Duration(cfg.RequestTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	if cfg.ClusterName == "" {
+		return d.fail(DiagnosisStageConfig, fmt.Errorf("cluster name required")), nil
+	}
+	if cfg.StoreConnInfo.Endpoints == "" {
+		return d.fail(DiagnosisStageConfig, fmt.Errorf("no store endpoints")), nil
+	}
+
+	var tlsConfig *tls.Config
+	var reachable = 0
+	var lastStage string
+	var lastErr error
+	for _, endp := range strings.Split(cfg.StoreConnInfo.Endpoints, ",") {
+		var ed = EndpointDiagnosis{Endpoint: endp}
+		stage, err := diagnoseEndpoint(ctx, &ed, &cfg.StoreConnInfo, &tlsConfig, timeout)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		d.Endpoints = append(d.Endpoints, ed)
+		if err != nil {
+			if stage == DiagnosisStageConfig {
+				return d.fail(stage, err), nil
+			}
+			// report the most advanced failure
+			if lastStage == "" || stageOrder(stage) > stageOrder(lastStage) {
+				lastStage, lastErr = stage, err
+			}
+			continue
+		}
+		reachable++
+	}
+	if reachable == 0 {
+		return d.fail(lastStage, lastErr), nil
+	}
+
+	cs, err := NewClusterStore(cfg)
+	if err != nil {
+		return d.fail(DiagnosisStageConfig, err), nil
+	}
+	defer cs.Close()
+	pair, err := cs.Store.Get(ctx, filepath.Join(cs.StorePath, "clusterdata"))
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		if isAuthError(err) {
+			return d.fail(DiagnosisStageAuth, err), nil
+		}
+		return d.fail(DiagnosisStageGet, err), nil
+	}
+	d.ClusterFound = pair != nil
+	return d, nil
+}
+
+func stageOrder(stage string) int {
+	for i, s := range []string{DiagnosisStageConfig, DiagnosisStageDNS, DiagnosisStageTCP,
+		DiagnosisStageTLS, DiagnosisStageAuth, DiagnosisStageGet} {
+		if s == stage {
+			return i
+		}
+	}
+	return -1
+}
+
+// returns failed stage and its error. *tlsConfig is created on first https
+// endpoint.
+func diagnoseEndpoint(ctx context.Context, ed *EndpointDiagnosis, ci *StoreConnInfo, tlsConfig **tls.Config, timeout time.Duration) (string, error) {
+	// etcd client accepts both urls and bare host:port
+	var hostport = ed.Endpoint
+	var secure = false
+	if strings.Contains(ed.Endpoint, "://") {
+		u, err := url.Parse(ed.Endpoint)
+		if err != nil {
+			return DiagnosisStageConfig, fmt.Errorf("invalid endpoint %q: %v", ed.Endpoint, err)
+		}
+		hostport = u.Host
+		secure = u.Scheme == "https"
+	}
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return DiagnosisStageConfig, fmt.Errorf("invalid endpoint %q: %v", ed.Endpoint, err)
+	}
+	if secure && *tlsConfig == nil {
+		*tlsConfig, err = tlswrap.NewTLSConfig(ci.CertFile, ci.Key, ci.CAFile, false)
+		if err != nil {
+			return DiagnosisStageConfig, fmt.Errorf("cannot create store tls config: %v", err)
+		}
+	}
+
+	dctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ed.Addrs, err = net.DefaultResolver.LookupHost(dctx, host)
+	if err != nil {
+		ed.DNSError = err.Error()
+		return DiagnosisStageDNS, err
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(dctx, "tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		ed.TCPError = err.Error()
+		return DiagnosisStageTCP, err
+	}
+	defer conn.Close()
+	if !secure {
+		return "", nil
+	}
+
+	var tc = (*tlsConfig).Clone()
+	tc.ServerName = host
+	// etcd speaks grpc over http2
+	tc.NextProtos = []string{"h2"}
+	tconn := tls.Client(conn, tc)
+	if deadline, ok := dctx.Deadline(); ok {
+		tconn.SetDeadline(deadline)
+	}
+	if err = tconn.Handshake(); err != nil {
+		ed.TLSError = err.Error()
+		return DiagnosisStageTLS, err
+	}
+	return "", nil
+}
+
+func isAuthError(err error) bool {
+	switch rpctypes.Error(err) {
+	case rpctypes.ErrPermissionDenied, rpctypes.ErrUserEmpty, rpctypes.ErrAuthFailed,
+		rpctypes.ErrInvalidAuthToken:
+		return true
+	}
+	return false
+}
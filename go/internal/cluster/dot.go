@@ -0,0 +1,100 @@
+// Copyright (c) 2019, Postgres Professional
+
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// Render current topology as Graphviz DOT digraph: a cluster (box) per
+// repgroup containing its master and healthy standbys with replication
+// edges; coordinator repgroup is drawn bold. Repgroups whose Stolon store is
+// unavailable are shown with the error.
+func (cs *ClusterStore) ExportTopologyDOT(ctx context.Context) (string, error) {
+	cldata, _, err := cs.GetClusterData(ctx)
+	if err != nil {
+		return "", fmt.Errorf("cannot get cluster data: %v", err)
+	}
+	if cldata == nil {
+		return "", fmt.Errorf("cluster data not found")
+	}
+	rgs, _, err := cs.GetRepGroups(ctx)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get repgroups: %v", err)
+	}
+	coordinator, _ := CoordinatorRgid(cldata, rgs) // 0 if none
+	var rgids = make([]int, 0, len(rgs))
+	for rgid, _ := range rgs {
+		rgids = append(rgids, rgid)
+	}
+	sort.Ints(rgids)
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "digraph %s {\n", strconv.Quote(cs.ClusterName))
+	b.WriteString("\tnode [shape=box];\n")
+	for _, rgid := range rgids {
+		rg := rgs[rgid]
+		var label = fmt.Sprintf("repgroup %d\n%s", rgid, rg.StolonName)
+		var style = ""
+		if rgid == coordinator {
+			label += "\ncoordinator"
+			style = "\t\tstyle=bold;\n"
+		}
+		if rg.Pending {
+			label += "\npending"
+		}
+		fmt.Fprintf(&b, "\tsubgraph %s {\n\t\tlabel=%s;\n%s", strconv.Quote(fmt.Sprintf("cluster_rg%d", rgid)),
+			strconv.Quote(label), style)
+
+		master, standbys, err := cs.repGroupTopology(ctx, rg)
+		masterNode := strconv.Quote(fmt.Sprintf("rg%d_master", rgid))
+		switch {
+		case err != nil:
+			fmt.Fprintf(&b, "\t\t%s [label=%s, color=red];\n", strconv.Quote(fmt.Sprintf("rg%d_error", rgid)),
+				strconv.Quote("unavailable: "+err.Error()))
+		case master == nil:
+			fmt.Fprintf(&b, "\t\t%s [label=\"no master\", color=red];\n", masterNode)
+		default:
+			fmt.Fprintf(&b, "\t\t%s [label=%s, peripheries=2];\n", masterNode,
+				strconv.Quote(fmt.Sprintf("master\n%s:%s", master.Address, master.Port)))
+		}
+		var uids = make([]string, 0, len(standbys))
+		for uid, _ := range standbys {
+			uids = append(uids, uid)
+		}
+		sort.Strings(uids)
+		for _, uid := range uids {
+			ep := standbys[uid]
+			node := strconv.Quote(fmt.Sprintf("rg%d_%s", rgid, uid))
+			fmt.Fprintf(&b, "\t\t%s [label=%s];\n", node,
+				strconv.Quote(fmt.Sprintf("standby %s\n%s:%s", uid, ep.Address, ep.Port)))
+			if master != nil {
+				fmt.Fprintf(&b, "\t\t%s -> %s;\n", masterNode, node)
+			}
+		}
+		b.WriteString("\t}\n")
+	}
+	b.WriteString("}\n")
+	return b.String(), nil
+}
+
+func (cs *ClusterStore) repGroupTopology(ctx context.Context, rg *RepGroup) (*Endpoint, map[string]*Endpoint, error) {
+	ss, release, err := cs.getStolonStore(rg)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
+	master, err := ss.GetMaster(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	standbys, err := ss.GetStandbys(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return master, standbys, nil
+}
@@ -0,0 +1,176 @@
+// Copyright (c) 2019, Postgres Professional
+
+// streaming dump and restore of cluster store
+package cluster
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"postgrespro.ru/shardman/internal/store"
+)
+
+// keys read from the store / written to it at once
+const dumpPageSize = 64
+
+// Write consistent snapshot of all cluster keys to w as json. The output has
+// the same layout as marshalled ClusterSnapshot, but keys are read and written
+// page by page, so memory usage doesn't depend on the size of the cluster.
+// Since revision is known only after the first read, it goes last.
+func (cs *ClusterStore) DumpCluster(ctx context.Context, w io.Writer) error {
+	if err := cs.checkUnfiltered(); err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	name, err := json.Marshal(cs.ClusterName)
+	if err != nil {
+		return err
+	}
+	now, err := json.Marshal(time.Now())
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(bw, "{\"ClusterName\":%s,\"Time\":%s,\"Keys\":{", name, now)
+
+	prefix := cs.StorePath + "/"
+	var first = true
+	rev, err := cs.Store.IteratePrefix(ctx, prefix, dumpPageSize, func(pair *store.KVPair) error {
+		key, err := json.Marshal(strings.TrimPrefix(pair.Key, prefix))
+		if err != nil {
+			return err
+		}
+		value, err := json.Marshal(pair.Value)
+		if err != nil {
+			return err
+		}
+		if !first {
+			bw.WriteByte(',')
+		}
+		first = false
+		bw.Write(key)
+		bw.WriteByte(':')
+		_, err = bw.Write(value)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read cluster keys: %v", err)
+	}
+	fmt.Fprintf(bw, "},\"Revision\":%d}\n", rev)
+	return bw.Flush()
+}
+
+// Write keys from dump produced by DumpCluster (or marshalled ClusterSnapshot)
+// back to the store. The dump is decoded entry by entry and written in
+// batches, so it is not atomic; that's why the cluster must be in maintenance
+// mode during restore, and its maintenance and generation keys are not
+// overwritten. Keys absent in the dump are left intact.
+func (cs *ClusterStore) RestoreCluster(ctx context.Context, r io.Reader) error {
+	if err := cs.checkUnfiltered(); err != nil {
+		return err
+	}
+	mm, mmpair, err := cs.GetMaintenanceMode(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot get maintenance mode: %v", err)
+	}
+	if mm == nil {
+		return fmt.Errorf("cluster must be in maintenance mode for restore")
+	}
+	guards := map[string]uint64{mmpair.Key: mmpair.LastIndex}
+
+	var ops []store.Op
+	flush := func() error {
+		if len(ops) == 0 {
+			return nil
+		}
+		err := cs.Store.AtomicMultiPut(ctx, append(ops, cs.generationOp()), guards)
+		if err == store.ErrKeyModified {
+			return fmt.Errorf("maintenance mode was reset during restore")
+		}
+		ops = ops[:0]
+		return err
+	}
+
+	dec := json.NewDecoder(r)
+	if err = expectDelim(dec, '{'); err != nil {
+		return err
+	}
+	var nameSeen = false
+	for dec.More() {
+		field, err := dec.Token()
+		if err != nil {
+			return fmt.Errorf("malformed dump: %v", err)
+		}
+		switch field {
+		case "ClusterName":
+			var name string
+			if err = dec.Decode(&name); err != nil {
+				return fmt.Errorf("malformed dump: %v", err)
+			}
+			if name != cs.ClusterName {
+				return fmt.Errorf("dump is of cluster %q, not %q", name, cs.ClusterName)
+			}
+			nameSeen = true
+		case "Keys":
+			if !nameSeen {
+				return fmt.Errorf("malformed dump: ClusterName must precede Keys")
+			}
+			if err = expectDelim(dec, '{'); err != nil {
+				return err
+			}
+			for dec.More() {
+				tok, err := dec.Token()
+				if err != nil {
+					return fmt.Errorf("malformed dump: %v", err)
+				}
+				key, _ := tok.(string)
+				path := filepath.Join(cs.StorePath, key)
+				if key == "" || !strings.HasPrefix(path, cs.StorePath+"/") {
+					return fmt.Errorf("invalid key %q in dump", key)
+				}
+				var value []byte
+				if err = dec.Decode(&value); err != nil {
+					return fmt.Errorf("malformed dump: key %q: %v", key, err)
+				}
+				if path == cs.maintenancePath() || path == cs.generationPath() {
+					continue
+				}
+				ops = append(ops, store.Op{Key: path, Value: value})
+				if len(ops) == dumpPageSize {
+					if err = flush(); err != nil {
+						return err
+					}
+				}
+			}
+			if err = expectDelim(dec, '}'); err != nil {
+				return err
+			}
+		default:
+			// Revision, Time and whatever else
+			var skip json.RawMessage
+			if err = dec.Decode(&skip); err != nil {
+				return fmt.Errorf("malformed dump: %v", err)
+			}
+		}
+	}
+	if err = expectDelim(dec, '}'); err != nil {
+		return err
+	}
+	return flush()
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return fmt.Errorf("malformed dump: %v", err)
+	}
+	if tok != delim {
+		return fmt.Errorf("malformed dump: expected %v, got %v", delim, tok)
+	}
+	return nil
+}
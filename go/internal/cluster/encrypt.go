@@ -0,0 +1,132 @@
+// Copyright (c) 2019, Postgres Professional
+
+// encryption of secrets in cluster data at rest
+package cluster
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// Encrypts secrets (PgSuPassword, PgReplPassword) of cluster data before it is
+// put into the store and decrypts them after get. Implement it to plug in KMS
+// or the like; NewAESGCMEncrypter is builtin local key implementation.
+type Encrypter interface {
+	Encrypt(plaintext []byte) ([]byte, error)
+	Decrypt(ciphertext []byte) ([]byte, error)
+}
+
+// marks encrypted values in the store
+const encryptedPrefix = "encrypted:"
+
+type aesGCMEncrypter struct {
+	aead cipher.AEAD
+}
+
+// AES-GCM with given 16, 24 or 32 bytes key; random nonce is prepended to
+// ciphertext
+func NewAESGCMEncrypter(key []byte) (Encrypter, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &aesGCMEncrypter{aead: aead}, nil
+}
+
+// Read hex-encoded AES key from file, see NewAESGCMEncrypter
+func NewAESGCMEncrypterFromFile(path string) (Encrypter, error) {
+	keyhex, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(keyhex)))
+	if err != nil {
+		return nil, fmt.Errorf("encryption key must be hex-encoded: %v", err)
+	}
+	return NewAESGCMEncrypter(key)
+}
+
+func (e *aesGCMEncrypter) Encrypt(plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, e.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return e.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func (e *aesGCMEncrypter) Decrypt(ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < e.aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext is too short")
+	}
+	nonce := ciphertext[:e.aead.NonceSize()]
+	return e.aead.Open(nil, nonce, ciphertext[e.aead.NonceSize():], nil)
+}
+
+// Encrypt secrets of cldata written by this store with e. nil disables
+// encryption; cluster data with encrypted secrets then can't be read.
+func (cs *ClusterStore) SetEncrypter(e Encrypter) {
+	cs.encrypter = e
+}
+
+func (cs *ClusterStore) encryptSecret(secret string) (string, error) {
+	if cs.encrypter == nil || secret == "" {
+		return secret, nil
+	}
+	ciphertext, err := cs.encrypter.Encrypt([]byte(secret))
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt: %v", err)
+	}
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+func (cs *ClusterStore) decryptSecret(stored string) (string, error) {
+	if !strings.HasPrefix(stored, encryptedPrefix) {
+		return stored, nil
+	}
+	if cs.encrypter == nil {
+		return "", fmt.Errorf("cluster data secrets are encrypted, but no encryption key is configured")
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(stored, encryptedPrefix))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt: %v", err)
+	}
+	plaintext, err := cs.encrypter.Decrypt(ciphertext)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt, wrong encryption key? %v", err)
+	}
+	return string(plaintext), nil
+}
+
+// copy of cldata with encrypted secrets
+func (cs *ClusterStore) encryptClusterData(cldata *ClusterData) (*ClusterData, error) {
+	var enc = *cldata
+	var err error
+	if enc.Spec.PgSuPassword, err = cs.encryptSecret(cldata.Spec.PgSuPassword); err != nil {
+		return nil, err
+	}
+	if enc.Spec.PgReplPassword, err = cs.encryptSecret(cldata.Spec.PgReplPassword); err != nil {
+		return nil, err
+	}
+	return &enc, nil
+}
+
+// decrypt secrets of cldata in place
+func (cs *ClusterStore) decryptClusterData(cldata *ClusterData) error {
+	var err error
+	if cldata.Spec.PgSuPassword, err = cs.decryptSecret(cldata.Spec.PgSuPassword); err != nil {
+		return err
+	}
+	cldata.Spec.PgReplPassword, err = cs.decryptSecret(cldata.Spec.PgReplPassword)
+	return err
+}
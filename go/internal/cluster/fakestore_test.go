@@ -0,0 +1,119 @@
+// Copyright (c) 2019, Postgres Professional
+
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+
+	pb "github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"google.golang.org/grpc"
+)
+
+var errFakeUnimplemented = errors.New("not implemented by fake store")
+
+// In-process etcd KV service serving plain gets and puts over loopback gRPC,
+// for tests which need a store, but not watches or txns
+type fakeKV struct {
+	mu  sync.Mutex
+	rev int64
+	kvs map[string]*mvccpb.KeyValue
+}
+
+func (f *fakeKV) Range(ctx context.Context, r *pb.RangeRequest) (*pb.RangeResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var resp = &pb.RangeResponse{Header: &pb.ResponseHeader{Revision: f.rev}}
+	if len(r.RangeEnd) == 0 {
+		if kv, ok := f.kvs[string(r.Key)]; ok {
+			resp.Kvs = []*mvccpb.KeyValue{kv}
+		}
+	} else {
+		for key, kv := range f.kvs {
+			if bytes.Compare([]byte(key), r.Key) >= 0 && bytes.Compare([]byte(key), r.RangeEnd) < 0 {
+				resp.Kvs = append(resp.Kvs, kv)
+			}
+		}
+		sort.Slice(resp.Kvs, func(i, j int) bool { return bytes.Compare(resp.Kvs[i].Key, resp.Kvs[j].Key) < 0 })
+	}
+	resp.Count = int64(len(resp.Kvs))
+	return resp, nil
+}
+
+func (f *fakeKV) Put(ctx context.Context, r *pb.PutRequest) (*pb.PutResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rev++
+	var kv = &mvccpb.KeyValue{Key: r.Key, Value: r.Value, ModRevision: f.rev, CreateRevision: f.rev, Version: 1}
+	if old, ok := f.kvs[string(r.Key)]; ok {
+		kv.CreateRevision, kv.Version = old.CreateRevision, old.Version+1
+	}
+	f.kvs[string(r.Key)] = kv
+	return &pb.PutResponse{Header: &pb.ResponseHeader{Revision: f.rev}}, nil
+}
+
+func (f *fakeKV) DeleteRange(ctx context.Context, r *pb.DeleteRangeRequest) (*pb.DeleteRangeResponse, error) {
+	return nil, errFakeUnimplemented
+}
+
+func (f *fakeKV) Txn(ctx context.Context, r *pb.TxnRequest) (*pb.TxnResponse, error) {
+	return nil, errFakeUnimplemented
+}
+
+func (f *fakeKV) Compact(ctx context.Context, r *pb.CompactionRequest) (*pb.CompactionResponse, error) {
+	return nil, errFakeUnimplemented
+}
+
+// Cluster store talking to fake store
+func newFakeClusterStore(tb testing.TB) *ClusterStore {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	pb.RegisterKVServer(srv, &fakeKV{kvs: make(map[string]*mvccpb.KeyValue)})
+	go srv.Serve(lis)
+
+	name := "fake"
+	cs, err := NewClusterStore(&ClusterStoreConnInfo{
+		ClusterName:    name,
+		StoreConnInfo:  StoreConnInfo{Endpoints: fmt.Sprintf("http://%s", lis.Addr())},
+		RequestTimeout: 5,
+	})
+	if err != nil {
+		srv.Stop()
+		tb.Fatalf("failed to create cluster store: %v", err)
+	}
+	tb.Cleanup(func() {
+		cs.Close()
+		srv.Stop()
+	})
+	return cs
+}
+
+func TestFakeStore(t *testing.T) {
+	cs := newFakeClusterStore(t)
+	ctx := context.Background()
+	rg := testRepGroup(cs)
+	putTestStolonMaster(t, cs, rg, "10.0.0.1")
+	ss := NewStolonStoreFromExisting(rg, cs.Store)
+	ep, err := ss.GetMaster(ctx)
+	if err != nil {
+		t.Fatalf("failed to get master: %v", err)
+	}
+	if ep == nil || ep.Address != "10.0.0.1" {
+		t.Fatalf("expected master 10.0.0.1, got %v", ep)
+	}
+	pair, err := cs.Store.Get(ctx, filepath.Join(rg.StorePrefix, rg.StolonName, "nonexistent"))
+	if err != nil || pair != nil {
+		t.Errorf("expected no key, got %v, %v", pair, err)
+	}
+}
@@ -0,0 +1,37 @@
+// Copyright (c) 2019, Postgres Professional
+
+// cheap detection of cluster configuration changes
+package cluster
+
+import (
+	"context"
+	"path/filepath"
+
+	"postgrespro.ru/shardman/internal/store"
+)
+
+// Generation is etcd version of this key, i.e. number of puts to it. Mutating
+// ClusterStore methods put it in the same transaction as their changes.
+func (cs *ClusterStore) generationPath() string {
+	return filepath.Join(cs.StorePath, "generation")
+}
+
+func (cs *ClusterStore) generationOp() store.Op {
+	return store.Op{Key: cs.generationPath()}
+}
+
+// Get cluster generation: it grows with every change of cluster configuration
+// (cluster data, repgroups, masters, feature flags etc) made via ClusterStore,
+// so if it is the same as on previous pass, nothing changed. 0 if there were
+// no changes yet.
+func (cs *ClusterStore) GetGeneration(ctx context.Context) (uint64, error) {
+	version, err := cs.Store.GetVersion(ctx, cs.generationPath())
+	return uint64(version), err
+}
+
+// Increment cluster generation and return the new one, e.g. to notify
+// reconcilers about change made bypassing ClusterStore
+func (cs *ClusterStore) BumpGeneration(ctx context.Context) (uint64, error) {
+	version, err := cs.Store.Touch(ctx, cs.generationPath())
+	return uint64(version), err
+}
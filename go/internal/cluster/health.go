@@ -0,0 +1,127 @@
+// Copyright (c) 2019, Postgres Professional
+
+// cluster-wide health summary
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"postgrespro.ru/shardman/internal/store"
+)
+
+// Overall cluster status
+const (
+	HealthGreen  = "green"  // everything is fine
+	HealthYellow = "yellow" // working, but redundancy is degraded
+	HealthRed    = "red"    // etcd quorum is lost or some repgroup has no master
+)
+
+type RepGroupHealth struct {
+	// Stolon reports healthy master; it is not probed here
+	MasterHealthy bool
+	// not ready yet (see RepGroup.Pending), doesn't affect Status
+	Pending bool
+	// registered in Stolon clusterdata; not necessarily alive
+	Keepers int
+	// alive ones, i.e. publishing their info in Stolon store
+	KeepersAlive   int
+	SentinelsAlive int
+	Error          string // why Stolon store couldn't be inspected
+}
+
+type HealthSummary struct {
+	Status           string // see Health* constants
+	EtcdMembers      []store.MemberHealth
+	EtcdHealthy      int
+	EtcdQuorum       bool
+	RepGroups        map[int]*RepGroupHealth
+	ReadyRepGroups   int
+	HealthyRepGroups int // among ready ones
+	MastersHealthy   int // among ready ones
+}
+
+// Aggregate health of etcd, and masters, keepers and sentinels of all
+// repgroups. Repgroup is healthy if Stolon reports its master healthy and all
+// its keepers and at least one sentinel are alive. Pending repgroups are
+// reported, but not counted. Stolon store problems of separate repgroups are
+// reported in the summary, not as error.
+func (cs *ClusterStore) ClusterHealthSummary(ctx context.Context) (*HealthSummary, error) {
+	var hs = &HealthSummary{RepGroups: make(map[int]*RepGroupHealth)}
+	members, err := cs.Store.MembersHealth(ctx)
+	if err != nil {
+		return nil, err
+	}
+	hs.EtcdMembers = members
+	for _, m := range members {
+		if m.Healthy {
+			hs.EtcdHealthy++
+		}
+	}
+	hs.EtcdQuorum = hs.EtcdHealthy > len(members)/2
+
+	rgs, _, err := cs.GetRepGroups(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get repgroups: %v", err)
+	}
+	for rgid, rg := range rgs {
+		rh := cs.repGroupHealth(ctx, rg)
+		rh.Pending = rg.Pending
+		hs.RepGroups[rgid] = rh
+		if rh.Pending {
+			continue
+		}
+		hs.ReadyRepGroups++
+		if rh.MasterHealthy {
+			hs.MastersHealthy++
+			if rh.KeepersAlive >= rh.Keepers && rh.SentinelsAlive > 0 {
+				hs.HealthyRepGroups++
+			}
+		}
+	}
+
+	switch {
+	case !hs.EtcdQuorum || hs.MastersHealthy < hs.ReadyRepGroups:
+		hs.Status = HealthRed
+	case hs.EtcdHealthy < len(members) || hs.HealthyRepGroups < hs.ReadyRepGroups:
+		hs.Status = HealthYellow
+	default:
+		hs.Status = HealthGreen
+	}
+	return hs, nil
+}
+
+func (cs *ClusterStore) repGroupHealth(ctx context.Context, rg *RepGroup) *RepGroupHealth {
+	var rh = &RepGroupHealth{}
+	ss, release, err := cs.getStolonStore(rg)
+	if err != nil {
+		rh.Error = err.Error()
+		return rh
+	}
+	defer release()
+	clusterData, err := ss.GetClusterData(ctx)
+	if err != nil {
+		rh.Error = err.Error()
+		return rh
+	}
+	if clusterData != nil {
+		rh.Keepers = len(clusterData.Keepers)
+		if db, ok := clusterData.DBs[clusterData.Proxy.Spec.MasterDBUID]; ok {
+			rh.MasterHealthy = db.Status.Healthy
+		}
+	}
+	// keepers and sentinels publish their info with ttl
+	keepers, err := ss.store.CountPrefix(ctx, filepath.Join(ss.storePath, "keepers", "info")+"/")
+	if err != nil {
+		rh.Error = err.Error()
+		return rh
+	}
+	sentinels, err := ss.store.CountPrefix(ctx, filepath.Join(ss.storePath, "sentinels", "info")+"/")
+	if err != nil {
+		rh.Error = err.Error()
+		return rh
+	}
+	rh.KeepersAlive, rh.SentinelsAlive = int(keepers), int(sentinels)
+	return rh
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2019, Postgres Professional
+
+// reading stored data written under old json field names
+package cluster
+
+import (
+	"encoding/json"
+)
+
+// Old json name -> current json name of fields of types stored in etcd. To
+// rename a field without breaking existing clusters, rename it and add old
+// name -> new name entry to the map of its type, so data written by previous
+// versions is still read. New name is always written, so the entry can be
+// dropped once all stored data was rewritten (any PutClusterData does it) and
+// older binaries are gone, but not earlier than in the next release. If both
+// names are present in stored object, the new one wins.
+var (
+	clusterDataJSONAliases = map[string]string{}
+	clusterSpecJSONAliases = map[string]string{}
+	repGroupJSONAliases    = map[string]string{}
+)
+
+// decode json object into v, first renaming keys according to aliases
+func unmarshalWithAliases(data []byte, aliases map[string]string, v interface{}) error {
+	if len(aliases) == 0 {
+		return json.Unmarshal(data, v)
+	}
+	var raws map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raws); err != nil {
+		return err
+	}
+	if raws == nil { // null
+		return nil
+	}
+	for oldname, newname := range aliases {
+		raw, ok := raws[oldname]
+		if !ok {
+			continue
+		}
+		delete(raws, oldname)
+		if _, ok := raws[newname]; !ok {
+			raws[newname] = raw
+		}
+	}
+	renamed, err := json.Marshal(raws)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(renamed, v)
+}
+
+// types without methods, to avoid recursion
+type plainClusterData ClusterData
+type plainClusterSpec ClusterSpec
+type plainRepGroup RepGroup
+
+func (cldata *ClusterData) UnmarshalJSON(data []byte) error {
+	return unmarshalWithAliases(data, clusterDataJSONAliases, (*plainClusterData)(cldata))
+}
+
+func (spec *ClusterSpec) UnmarshalJSON(data []byte) error {
+	return unmarshalWithAliases(data, clusterSpecJSONAliases, (*plainClusterSpec)(spec))
+}
+
+func (rg *RepGroup) UnmarshalJSON(data []byte) error {
+	return unmarshalWithAliases(data, repGroupJSONAliases, (*plainRepGroup)(rg))
+}
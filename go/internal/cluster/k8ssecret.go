@@ -0,0 +1,46 @@
+// Copyright (c) 2019, Postgres Professional
+
+package cluster
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ghodss/yaml"
+)
+
+// subset of k8s core/v1 Secret
+type k8sSecret struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace,omitempty"`
+	} `json:"metadata"`
+	Type string `json:"type"`
+	// encoding/json writes []byte as base64, as Secret data must be
+	Data map[string][]byte `json:"data"`
+}
+
+// Form YAML manifest of Kubernetes Secret with su connection options (host,
+// port, user, password, dbname) of rg's current master, suitable for kubectl
+// apply. Empty namespace means the default one. password is omitted with
+// trust auth.
+func (cs *ClusterStore) GenerateK8sSecret(ctx context.Context, rg *RepGroup, cldata *ClusterData, secretName string, namespace string) ([]byte, error) {
+	if secretName == "" {
+		return nil, fmt.Errorf("secret name required")
+	}
+	cp, _, err := cs.GetSuConnstrMapOpts(ctx, rg, cldata, &ConnstrOpts{})
+	if err != nil {
+		return nil, err
+	}
+	var secret = k8sSecret{APIVersion: "v1", Kind: "Secret", Type: "Opaque", Data: make(map[string][]byte)}
+	secret.Metadata.Name = secretName
+	secret.Metadata.Namespace = namespace
+	for _, opt := range []string{"host", "port", "user", "password", "dbname"} {
+		if val, ok := cp[opt]; ok {
+			secret.Data[opt] = []byte(val)
+		}
+	}
+	return yaml.Marshal(&secret)
+}
@@ -0,0 +1,145 @@
+// Copyright (c) 2019, Postgres Professional
+
+// maintenance mode and consistent snapshots of cluster store
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"postgrespro.ru/shardman/internal/store"
+)
+
+var ErrMaintenanceMode = errors.New("cluster is in maintenance mode, changes are not allowed")
+
+type MaintenanceMode struct {
+	Reason string
+	Since  time.Time
+}
+
+func (cs *ClusterStore) maintenancePath() string {
+	return filepath.Join(cs.StorePath, "maintenance")
+}
+
+// Get current maintenance mode; nil if cluster is not in maintenance
+func (cs *ClusterStore) GetMaintenanceMode(ctx context.Context) (*MaintenanceMode, *store.KVPair, error) {
+	var mm *MaintenanceMode
+	pair, err := cs.Store.Get(ctx, cs.maintenancePath())
+	if err != nil {
+		return nil, nil, err
+	}
+	if pair == nil {
+		return nil, nil, nil
+	}
+	if err := json.Unmarshal(pair.Value, &mm); err != nil {
+		return nil, nil, err
+	}
+	return mm, pair, nil
+}
+
+// Put cluster into maintenance mode, blocking changes of cluster data,
+// repgroups and feature flags. Fails if it is already there.
+func (cs *ClusterStore) SetMaintenanceMode(ctx context.Context, reason string) (*store.KVPair, error) {
+	mmj, err := json.Marshal(&MaintenanceMode{Reason: reason, Since: time.Now()})
+	if err != nil {
+		return nil, err
+	}
+	pair, err := cs.Store.AtomicPut(ctx, cs.maintenancePath(), mmj, nil, cs.generationOp())
+	if err == store.ErrKeyModified {
+		return nil, fmt.Errorf("cluster is already in maintenance mode")
+	}
+	return pair, err
+}
+
+// Leave maintenance mode. If pair is not nil, maintenance mode is cleared only
+// if it wasn't reset since pair was read.
+func (cs *ClusterStore) ClearMaintenanceMode(ctx context.Context, pair *store.KVPair) error {
+	var guards map[string]uint64
+	if pair != nil {
+		guards = map[string]uint64{pair.Key: pair.LastIndex}
+	}
+	err := cs.Store.AtomicMultiPut(ctx, []store.Op{{Key: cs.maintenancePath(), Delete: true}, cs.generationOp()}, guards)
+	if err == store.ErrKeyModified {
+		return fmt.Errorf("maintenance mode was reset by someone else")
+	}
+	return err
+}
+
+// Apply ops of config change in one txn with given guards, provided that
+// cluster is not in maintenance mode. Generation is bumped as well.
+func (cs *ClusterStore) putGuarded(ctx context.Context, ops []store.Op, guards map[string]uint64) error {
+	var allguards = map[string]uint64{cs.maintenancePath(): 0}
+	for key, rev := range guards {
+		allguards[key] = rev
+	}
+	err := cs.Store.AtomicMultiPut(ctx, append(append([]store.Op{}, ops...), cs.generationOp()), allguards)
+	if err == store.ErrKeyModified {
+		if mm, _, merr := cs.GetMaintenanceMode(ctx); merr == nil && mm != nil {
+			return ErrMaintenanceMode
+		}
+	}
+	return err
+}
+
+// All keys of the cluster read at one store revision
+type ClusterSnapshot struct {
+	ClusterName string
+	Revision    int64
+	Time        time.Time
+	// key (relative to cluster store path) -> value
+	Keys map[string][]byte
+}
+
+// Take consistent snapshot of all cluster keys
+func (cs *ClusterStore) GetClusterSnapshot(ctx context.Context) (*ClusterSnapshot, error) {
+	if err := cs.checkUnfiltered(); err != nil {
+		return nil, err
+	}
+	prefix := cs.StorePath + "/"
+	pairs, rev, err := cs.Store.GetPrefix(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	var snap = &ClusterSnapshot{
+		ClusterName: cs.ClusterName,
+		Revision:    rev,
+		Time:        time.Now(),
+		Keys:        make(map[string][]byte, len(pairs)),
+	}
+	for _, pair := range pairs {
+		snap.Keys[strings.TrimPrefix(pair.Key, prefix)] = pair.Value
+	}
+	return snap, nil
+}
+
+// List all cluster keys with sizes and revisions, for debugging
+func (cs *ClusterStore) InspectKeys(ctx context.Context) ([]store.KeyInfo, error) {
+	return cs.Store.InspectPrefix(ctx, cs.StorePath+"/")
+}
+
+// Prepare for upgrade of shardman itself: put cluster into maintenance mode
+// and write consistent snapshot of the store to w (see DumpCluster). Returned
+// func leaves maintenance mode once upgrade is done. On error, maintenance
+// mode is cleared before return.
+func (cs *ClusterStore) PrepareForUpgrade(ctx context.Context, w io.Writer) (func(context.Context) error, error) {
+	mmpair, err := cs.SetMaintenanceMode(ctx, "upgrade")
+	if err != nil {
+		return nil, err
+	}
+	if err = cs.DumpCluster(ctx, w); err != nil {
+		if cerr := cs.ClearMaintenanceMode(ctx, mmpair); cerr != nil {
+			return nil, fmt.Errorf("failed to take snapshot: %v; failed to clear maintenance mode: %v", err, cerr)
+		}
+		return nil, fmt.Errorf("failed to take snapshot: %v", err)
+	}
+	completeUpgrade := func(ctx context.Context) error {
+		return cs.ClearMaintenanceMode(ctx, mmpair)
+	}
+	return completeUpgrade, nil
+}
@@ -0,0 +1,146 @@
+// Copyright (c) 2019, Postgres Professional
+
+// short-lived cache of repgroup masters for GetSuConnstrMap*
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type masterCacheEntry struct {
+	ep      Endpoint
+	expires time.Time
+}
+
+// Safe for concurrent use; nil cache is always empty.
+type masterCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]masterCacheEntry
+	// Stolon stores we watch, and how to start watching new one; nil in
+	// tests
+	watched map[string]bool
+	watch   func(rg *RepGroup)
+	cancel  context.CancelFunc
+}
+
+// Stolon instance identity; rgid is not known to GetSuConnstrMap* callers
+func masterCacheKey(rg *RepGroup) string {
+	return strings.Join([]string{rg.StoreConnInfo.Endpoints, rg.StorePrefix, rg.StolonName}, "|")
+}
+
+func (c *masterCache) get(rg *RepGroup) *Endpoint {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := masterCacheKey(rg)
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return nil
+	}
+	var ep = entry.ep
+	return &ep
+}
+
+func (c *masterCache) put(rg *RepGroup, ep *Endpoint) {
+	if c == nil {
+		return
+	}
+	key := masterCacheKey(rg)
+	c.mu.Lock()
+	c.entries[key] = masterCacheEntry{ep: *ep, expires: time.Now().Add(c.ttl)}
+	var startWatch = c.watch != nil && !c.watched[key]
+	if startWatch {
+		c.watched[key] = true
+	}
+	c.mu.Unlock()
+	if startWatch {
+		c.watch(rg)
+	}
+}
+
+func (c *masterCache) invalidate(rg *RepGroup) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, masterCacheKey(rg))
+}
+
+// Drop cached master of rg unless it is ep (nil means there is no master now)
+func (c *masterCache) invalidateUnless(rg *RepGroup, ep *Endpoint) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := masterCacheKey(rg)
+	entry, ok := c.entries[key]
+	if ok && (ep == nil || entry.ep.Address != ep.Address || entry.ep.Port != ep.Port ||
+		entry.ep.Priority != ep.Priority) {
+		delete(c.entries, key)
+	}
+}
+
+// Watch Stolon cluster data of rg until ctx is done, dropping cached master as
+// soon as it changes. If Stolon store can't be watched, cached master is
+// dropped and watch is retried on next put.
+func (cs *ClusterStore) watchCachedMaster(ctx context.Context, c *masterCache, rg *RepGroup) {
+	ss, release, err := cs.getStolonStore(rg)
+	if err != nil {
+		c.mu.Lock()
+		delete(c.watched, masterCacheKey(rg))
+		delete(c.entries, masterCacheKey(rg))
+		c.mu.Unlock()
+		return
+	}
+	in := watchKey(ctx, &ss.store, filepath.Join(ss.storePath, "clusterdata"))
+	go func() {
+		defer release()
+		for pair := range in {
+			var ep *Endpoint = nil
+			if pair != nil {
+				var clusterData StolonClusterData
+				if err := json.Unmarshal(pair.Value, &clusterData); err == nil {
+					ep = clusterData.master()
+				}
+			}
+			c.invalidateUnless(rg, ep)
+		}
+	}()
+}
+
+// Cache masters (not proxies) found by GetSuConnstrMap* for ttl, so repeated
+// calls don't go to Stolon store each time. Once master of some Stolon is
+// cached, its cluster data is watched, and cached master is dropped as soon as
+// it changes; call ForgetMaster if connection to it fails. ttl 0 disables the
+// cache. Must be called before the store is used concurrently; watches stop
+// on Close.
+func (cs *ClusterStore) EnableMasterCache(ttl time.Duration) {
+	if cs.masterCache != nil {
+		cs.masterCache.cancel()
+	}
+	if ttl <= 0 {
+		cs.masterCache = nil
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &masterCache{ttl: ttl, entries: make(map[string]masterCacheEntry),
+		watched: make(map[string]bool), cancel: cancel}
+	c.watch = func(rg *RepGroup) { cs.watchCachedMaster(ctx, c, rg) }
+	cs.masterCache = c
+}
+
+// Drop cached master of rg, e.g. when connection to it failed
+func (cs *ClusterStore) ForgetMaster(rg *RepGroup) {
+	cs.masterCache.invalidate(rg)
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2019, Postgres Professional
+
+// exposing metrics without Prometheus client library
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+
+	"postgrespro.ru/shardman/internal/store"
+)
+
+// Gauges describing current cluster topology
+type TopologyGauges struct {
+	RepGroups int
+	// rgid -> 1 if master is available, 0 otherwise
+	MasterUp        map[int]int
+	MaintenanceMode int
+}
+
+func (cs *ClusterStore) GetTopologyGauges(ctx context.Context) (*TopologyGauges, error) {
+	rgs, _, err := cs.GetRepGroups(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get repgroups: %v", err)
+	}
+	var tg = &TopologyGauges{RepGroups: len(rgs), MasterUp: make(map[int]int)}
+	for rgid, rg := range rgs {
+		ss, release, err := cs.getStolonStore(rg)
+		if err != nil {
+			return nil, err
+		}
+		master, err := ss.GetMaster(ctx)
+		release()
+		if err == nil && master != nil {
+			tg.MasterUp[rgid] = 1
+		} else {
+			tg.MasterUp[rgid] = 0
+		}
+	}
+	mm, _, err := cs.GetMaintenanceMode(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if mm != nil {
+		tg.MaintenanceMode = 1
+	}
+	return tg, nil
+}
+
+// Write store requests stats and topology gauges in OpenMetrics text format
+// to w, e.g. http response with Content-Type store.OpenMetricsContentType.
+// Topology is read at call time, so each call costs a few store requests.
+func (cs *ClusterStore) WriteOpenMetrics(ctx context.Context, w io.Writer) error {
+	tg, err := cs.GetTopologyGauges(store.WithMetricsLabel(ctx, "monitoring"))
+	if err != nil {
+		return err
+	}
+	if err = cs.Store.Metrics().WriteOpenMetrics(w); err != nil {
+		return err
+	}
+
+	var rgids = make([]int, 0, len(tg.MasterUp))
+	for rgid, _ := range tg.MasterUp {
+		rgids = append(rgids, rgid)
+	}
+	sort.Ints(rgids)
+	fmt.Fprintf(w, "# TYPE shardman_repgroups gauge\n")
+	fmt.Fprintf(w, "# HELP shardman_repgroups Number of repgroups.\n")
+	fmt.Fprintf(w, "shardman_repgroups %d\n", tg.RepGroups)
+	fmt.Fprintf(w, "# TYPE shardman_repgroup_master_up gauge\n")
+	fmt.Fprintf(w, "# HELP shardman_repgroup_master_up Whether repgroup has available master.\n")
+	for _, rgid := range rgids {
+		fmt.Fprintf(w, "shardman_repgroup_master_up{rgid=\"%d\"} %d\n", rgid, tg.MasterUp[rgid])
+	}
+	fmt.Fprintf(w, "# TYPE shardman_maintenance_mode gauge\n")
+	fmt.Fprintf(w, "# HELP shardman_maintenance_mode Whether cluster is in maintenance mode.\n")
+	fmt.Fprintf(w, "shardman_maintenance_mode %d\n", tg.MaintenanceMode)
+	_, err = fmt.Fprintf(w, "# EOF\n")
+	return err
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2019, Postgres Professional
+
+// two-phase repgroup onboarding
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+
+	"postgrespro.ru/shardman/internal/store"
+)
+
+// Repgroups not marked as Pending
+func ReadyRepGroups(rgs map[int]*RepGroup) map[int]*RepGroup {
+	var res = make(map[int]*RepGroup, len(rgs))
+	for rgid, rg := range rgs {
+		if !rg.Pending {
+			res[rgid] = rg
+		}
+	}
+	return res
+}
+
+// Register new repgroup rgid as pending: it is saved in the store, but
+// connstr and placement helpers ignore it until MarkRepGroupReady. Fails if
+// rgid already exists.
+func (cs *ClusterStore) AddRepGroupPending(ctx context.Context, rgid int, rg *RepGroup) error {
+	var pending = *rg
+	pending.Pending = true
+	return cs.modifyRepGroup(ctx, rgid, func(rgs map[int]*RepGroup) error {
+		if _, ok := rgs[rgid]; ok {
+			return fmt.Errorf("repgroup %d already exists", rgid)
+		}
+		rgs[rgid] = &pending
+		return nil
+	})
+}
+
+// Make pending repgroup available for work
+func (cs *ClusterStore) MarkRepGroupReady(ctx context.Context, rgid int) error {
+	return cs.modifyRepGroup(ctx, rgid, func(rgs map[int]*RepGroup) error {
+		rg, ok := rgs[rgid]
+		if !ok {
+			return fmt.Errorf("repgroup %d not found", rgid)
+		}
+		if !rg.Pending {
+			return fmt.Errorf("repgroup %d is not pending", rgid)
+		}
+		rg.Pending = false
+		return nil
+	})
+}
+
+// read-modify-write of repgroups as single CAS; storage doesn't have masters
+// of the modified repgroup yet, so unlike PutRepGroups they are not touched
+func (cs *ClusterStore) modifyRepGroup(ctx context.Context, rgid int, modify func(rgs map[int]*RepGroup) error) error {
+	if err := cs.checkUnfiltered(); err != nil {
+		return err
+	}
+	rgs, pair, err := cs.GetRepGroups(ctx)
+	if err != nil {
+		return fmt.Errorf("Failed to get repgroups: %v", err)
+	}
+	if rgs == nil {
+		rgs = make(map[int]*RepGroup)
+	}
+	if err = modify(rgs); err != nil {
+		return err
+	}
+	rgsj, err := json.Marshal(rgs)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(cs.StorePath, "repgroups")
+	var guard uint64 = 0
+	if pair != nil {
+		guard = pair.LastIndex
+	}
+	return cs.putGuarded(ctx, []store.Op{{Key: path, Value: rgsj}}, map[string]uint64{path: guard})
+}
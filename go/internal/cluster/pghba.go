@@ -0,0 +1,56 @@
+// Copyright (c) 2019, Postgres Professional
+
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+)
+
+// Form pg_hba.conf lines allowing su user to connect from every Postgres
+// instance (any of them might become master) of given repgroups with
+// configured su auth method, as required by FDW between repgroups. Lines are
+// sorted, so the result is stable and can be put into Stolon spec pgHBA.
+func (cs *ClusterStore) GeneratePgHba(ctx context.Context, rgs map[int]*RepGroup, cldata *ClusterData) ([]string, error) {
+	if cldata.Spec.PgSuUsername == "" || cldata.Spec.PgSuAuthMethod == "" {
+		return nil, fmt.Errorf("su user or auth method is not configured")
+	}
+	var addrs = make(map[string]bool)
+	for rgid, rg := range rgs {
+		ss, release, err := cs.getStolonStore(rg)
+		if err != nil {
+			return nil, err
+		}
+		dbs, err := ss.GetDBs(ctx)
+		release()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get Postgres instances of repgroup %d: %v", rgid, err)
+		}
+		for _, ep := range dbs {
+			addrs[hbaAddress(ep.Address)] = true
+		}
+	}
+
+	var lines = make([]string, 0, len(addrs))
+	for addr, _ := range addrs {
+		lines = append(lines, fmt.Sprintf("host all %s %s %s",
+			cldata.Spec.PgSuUsername, addr, cldata.Spec.PgSuAuthMethod))
+	}
+	sort.Strings(lines)
+	return lines, nil
+}
+
+// pg_hba address field for a single host
+func hbaAddress(host string) string {
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return host // hostname
+	case ip.To4() != nil:
+		return ip.String() + "/32"
+	default:
+		return ip.String() + "/128"
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2019, Postgres Professional
+
+// distribution of partitions among repgroups
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+func (rg *RepGroup) effectiveWeight() int {
+	if rg.Weight <= 0 {
+		return 1
+	}
+	return rg.Weight
+}
+
+// Propose partition num -> rgid mapping for a new table with numPartitions
+// partitions according to configured placement strategy and current
+// repgroups. The result is deterministic for the same repgroups.
+func (cs *ClusterStore) ProposePartitionPlacement(ctx context.Context, numPartitions int) (map[int]int, error) {
+	cldata, _, err := cs.GetClusterData(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get cluster data: %v", err)
+	}
+	if cldata == nil {
+		return nil, fmt.Errorf("cluster data not found")
+	}
+	rgs, _, err := cs.GetRepGroups(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get repgroups: %v", err)
+	}
+	rgs = ReadyRepGroups(rgs)
+	if len(rgs) == 0 {
+		return nil, fmt.Errorf("no repgroups in cluster")
+	}
+	return proposePlacement(cldata.Spec.PlacementStrategy, rgs, numPartitions)
+}
+
+func proposePlacement(strategy string, rgs map[int]*RepGroup, numPartitions int) (map[int]int, error) {
+	var rgids = make([]int, 0, len(rgs))
+	for rgid, _ := range rgs {
+		rgids = append(rgids, rgid)
+	}
+	sort.Ints(rgids)
+
+	var placement = make(map[int]int)
+	switch strategy {
+	case "", PlacementStrategyRoundRobin:
+		for pnum := 0; pnum < numPartitions; pnum++ {
+			placement[pnum] = rgids[pnum%len(rgids)]
+		}
+	case PlacementStrategyWeighted:
+		// smooth weighted round robin: spreads parts of heavy
+		// repgroups evenly instead of assigning them in a row
+		var current = make(map[int]int)
+		var total = 0
+		for _, rgid := range rgids {
+			total += rgs[rgid].effectiveWeight()
+		}
+		for pnum := 0; pnum < numPartitions; pnum++ {
+			var best = -1
+			for _, rgid := range rgids {
+				current[rgid] += rgs[rgid].effectiveWeight()
+				if best == -1 || current[rgid] > current[best] {
+					best = rgid
+				}
+			}
+			current[best] -= total
+			placement[pnum] = best
+		}
+	default:
+		return nil, fmt.Errorf("unknown placement strategy %q", strategy)
+	}
+	return placement, nil
+}
+
+// Check that every repgroup referenced by partition num -> rgid placement
+// exists and is not pending
+func (cs *ClusterStore) ValidatePartitionPlacement(ctx context.Context, placement map[int]int) error {
+	var rgids = make([]int, 0, len(placement))
+	for _, rgid := range placement {
+		rgids = append(rgids, rgid)
+	}
+	exist, err := cs.RepGroupsExist(ctx, rgids)
+	if err != nil {
+		return fmt.Errorf("Failed to get repgroups: %v", err)
+	}
+	var pnums = make([]int, 0, len(placement))
+	for pnum, _ := range placement {
+		pnums = append(pnums, pnum)
+	}
+	sort.Ints(pnums)
+	for _, pnum := range pnums {
+		if !exist[placement[pnum]] {
+			return fmt.Errorf("partition %d is placed on nonexistent or pending repgroup %d", pnum, placement[pnum])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+// Copyright (c) 2019, Postgres Professional
+
+// arbitrary user keys under cluster prefix
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"postgrespro.ru/shardman/internal/store"
+)
+
+// Top-level keys under cluster prefix managed by shardman itself
+var reservedKeys = map[string]bool{
+	"clusterdata":  true,
+	"repgroups":    true,
+	"masters":      true,
+	"featureflags": true,
+	"spechistory":  true,
+	"versions":     true,
+	"maintenance":  true,
+	"rebalance":    true,
+	"generation":   true,
+}
+
+// subkey must be namespace/name..., namespace not being reserved
+func (cs *ClusterStore) rawKeyPath(subkey string) (string, error) {
+	if subkey == "" || filepath.IsAbs(subkey) || filepath.Clean(subkey) != subkey ||
+		strings.HasPrefix(subkey, "..") {
+		return "", fmt.Errorf("invalid key %q", subkey)
+	}
+	parts := strings.SplitN(subkey, "/", 2)
+	if len(parts) < 2 {
+		return "", fmt.Errorf("key %q must be namespaced, e.g. annotations/%s", subkey, subkey)
+	}
+	if reservedKeys[parts[0]] {
+		return "", fmt.Errorf("key %q is reserved", parts[0])
+	}
+	return filepath.Join(cs.StorePath, subkey), nil
+}
+
+// Get value of subkey (e.g. "annotations/owner") under cluster prefix; nil if
+// there is no such key. Keys managed by shardman can't be read this way.
+func (cs *ClusterStore) GetRaw(ctx context.Context, subkey string) (*store.KVPair, error) {
+	path, err := cs.rawKeyPath(subkey)
+	if err != nil {
+		return nil, err
+	}
+	return cs.Store.Get(ctx, path)
+}
+
+// Put value of subkey under cluster prefix, see GetRaw. Fails with
+// ErrMaintenanceMode if cluster is in maintenance mode.
+func (cs *ClusterStore) PutRaw(ctx context.Context, subkey string, value []byte) error {
+	path, err := cs.rawKeyPath(subkey)
+	if err != nil {
+		return err
+	}
+	return cs.putGuarded(ctx, []store.Op{{Key: path, Value: value}}, nil)
+}
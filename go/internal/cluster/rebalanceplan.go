@@ -0,0 +1,152 @@
+// Copyright (c) 2019, Postgres Professional
+
+// planning of partition moves
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"sort"
+
+	"postgrespro.ru/shardman/internal/store"
+)
+
+// Planned move of a single partition
+type PartitionMove struct {
+	Schema   string
+	Relname  string // unquoted
+	Pnum     int
+	FromRgid int
+	ToRgid   int
+}
+
+// Plan moves bringing placement of each table towards its ideal weighted
+// (see RepGroup.Weight) distribution among rgs with minimal number of moves.
+// Colocated tables are moved along with their references. Partitions on
+// repgroups not in rgs are always moved, pending repgroups get nothing.
+// Nothing is executed; the result is deterministic for the same input.
+func PlanRebalance(tables []Table, rgs map[int]*RepGroup) []PartitionMove {
+	var moves = make([]PartitionMove, 0)
+	rgs = ReadyRepGroups(rgs)
+	if len(rgs) == 0 {
+		return moves
+	}
+	var rgids = make([]int, 0, len(rgs))
+	for rgid, _ := range rgs {
+		rgids = append(rgids, rgid)
+	}
+	sort.Ints(rgids)
+
+	for _, table := range tables {
+		if table.ColocateWithRelname != "" {
+			continue // colocated tables follow their references
+		}
+		var parts = make(map[int][]int) // rgid -> pnums
+		for pnum, rgid := range table.Partmap {
+			parts[rgid] = append(parts[rgid], pnum)
+		}
+		ideal := idealCounts(rgids, rgs, parts, len(table.Partmap))
+
+		// collect surplus, preferring to keep lower pnums in place
+		var surplus []PartitionMove
+		var srcRgids = make([]int, 0, len(parts))
+		for rgid, _ := range parts {
+			srcRgids = append(srcRgids, rgid)
+		}
+		sort.Ints(srcRgids)
+		for _, rgid := range srcRgids {
+			pnums := parts[rgid]
+			for i := ideal[rgid]; i < len(pnums); i++ {
+				surplus = append(surplus, PartitionMove{Pnum: pnums[i], FromRgid: rgid})
+			}
+		}
+		// and give it to repgroups lacking parts
+		var next = 0
+		for _, rgid := range rgids {
+			for have := len(parts[rgid]); have < ideal[rgid]; have++ {
+				move := surplus[next]
+				next++
+				move.ToRgid = rgid
+				move.Schema, move.Relname = table.Schema, table.Relname
+				moves = append(moves, move)
+				for _, ctable := range tables {
+					if ctable.ColocateWithSchema == table.Schema &&
+						ctable.ColocateWithRelname == table.Relname {
+						cmove := move
+						cmove.Schema, cmove.Relname = ctable.Schema, ctable.Relname
+						moves = append(moves, cmove)
+					}
+				}
+			}
+		}
+	}
+	return moves
+}
+
+// Number of parts each repgroup should have: proportional to weight, the
+// remainder going to repgroups with largest fractions, then to those already
+// having more parts (to save moves), then to lower rgids.
+func idealCounts(rgids []int, rgs map[int]*RepGroup, parts map[int][]int, nparts int) map[int]int {
+	var total = 0
+	for _, rgid := range rgids {
+		total += rgs[rgid].effectiveWeight()
+	}
+	var ideal = make(map[int]int)
+	var fracs = make(map[int]int)
+	var assigned = 0
+	for _, rgid := range rgids {
+		share := nparts * rgs[rgid].effectiveWeight()
+		ideal[rgid] = share / total
+		fracs[rgid] = share % total
+		assigned += ideal[rgid]
+	}
+	var order = append([]int(nil), rgids...)
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := order[i], order[j]
+		if fracs[a] != fracs[b] {
+			return fracs[a] > fracs[b]
+		}
+		return len(parts[a]) > len(parts[b])
+	})
+	for i := 0; assigned < nparts; i++ {
+		ideal[order[i]]++
+		assigned++
+	}
+	return ideal
+}
+
+// Rebalance plan being applied and which of its moves are already done
+type RebalanceProgress struct {
+	Plan []PartitionMove
+	Done []bool
+}
+
+func (cs *ClusterStore) rebalancePath() string {
+	return filepath.Join(cs.StorePath, "rebalance")
+}
+
+// Get progress of interrupted (or running) rebalance; nil if there is none
+func (cs *ClusterStore) GetRebalanceProgress(ctx context.Context) (*RebalanceProgress, error) {
+	pair, err := cs.Store.Get(ctx, cs.rebalancePath())
+	if err != nil || pair == nil {
+		return nil, err
+	}
+	var progress *RebalanceProgress
+	if err = json.Unmarshal(pair.Value, &progress); err != nil {
+		return nil, err
+	}
+	return progress, nil
+}
+
+// Save rebalance progress; nil removes it
+func (cs *ClusterStore) PutRebalanceProgress(ctx context.Context, progress *RebalanceProgress) error {
+	if progress == nil {
+		return cs.putGuarded(ctx, []store.Op{{Key: cs.rebalancePath(), Delete: true}}, nil)
+	}
+	progressj, err := json.Marshal(progress)
+	if err != nil {
+		return err
+	}
+	return cs.putGuarded(ctx, []store.Op{{Key: cs.rebalancePath(), Value: progressj}}, nil)
+}
@@ -0,0 +1,185 @@
+// Copyright (c) 2019, Postgres Professional
+
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"postgrespro.ru/shardman/internal/shmnlog"
+	"postgrespro.ru/shardman/internal/store"
+)
+
+const defaultMastersReconcileInterval = 5 * time.Second
+
+// Periodically saves current masters of all repgroups to masters key, so
+// that they are known even when Stolon stores are not available (see
+// ConnstrOpts.AllowStale). Running several reconcilers is safe. While cluster
+// is in maintenance mode, masters are not saved, so that planned failovers
+// don't end up there.
+type MastersReconciler struct {
+	cs       *ClusterStore
+	hl       *shmnlog.Logger
+	Interval time.Duration
+}
+
+func NewMastersReconciler(cs *ClusterStore, hl *shmnlog.Logger) *MastersReconciler {
+	return &MastersReconciler{cs: cs, hl: hl, Interval: defaultMastersReconcileInterval}
+}
+
+// Run until ctx is done. Errors are logged and retried at next round.
+func (r *MastersReconciler) Run(ctx context.Context) {
+	ctx = store.WithMetricsLabel(ctx, "reconcile")
+	mmch := watchKey(ctx, &r.cs.Store, r.cs.maintenancePath())
+	var paused = false
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case pair := <-mmch:
+			if pair != nil {
+				// undecodable value still means maintenance
+				var mm MaintenanceMode
+				if err := json.Unmarshal(pair.Value, &mm); err != nil {
+					r.hl.Errorf("cannot decode maintenance mode, pausing masters reconciler: %v", err)
+				} else if !paused {
+					r.hl.Infof("cluster is in maintenance mode (%s), pausing masters reconciler", mm.Reason)
+				}
+				paused = true
+			} else if paused {
+				r.hl.Infof("maintenance mode is over, resuming masters reconciler")
+				paused = false
+				timer.Reset(0)
+			}
+			continue
+		case <-timer.C:
+		}
+		if !paused {
+			err := r.reconcile(ctx)
+			if err != nil && err != ErrMaintenanceMode && ctx.Err() == nil {
+				r.hl.Warnf("failed to save masters: %v", err)
+			}
+		}
+		timer.Reset(r.Interval)
+	}
+}
+
+func (r *MastersReconciler) reconcile(ctx context.Context) error {
+	if err := r.cs.checkUnfiltered(); err != nil {
+		return err
+	}
+	rgs, rgpair, err := r.cs.GetRepGroups(ctx)
+	if err != nil {
+		return err
+	}
+	saved, pair, err := r.cs.GetMasters(ctx)
+	_, corrupt := err.(*MastersCorruptError)
+	if err != nil && !corrupt {
+		return err
+	}
+
+	// only repgroups we've read, so masters of removed ones are dropped
+	var masters = make(map[int]*Master)
+	// salvaged entries may all match, but the broken json must be rewritten
+	var changed = corrupt
+	for rgid, rg := range rgs {
+		var ep *Endpoint
+		ss, release, err := r.cs.getStolonStore(rg)
+		if err == nil {
+			ep, err = ss.GetMaster(ctx)
+			release()
+		}
+		if err != nil || ep == nil {
+			// keep last known one
+			if m, ok := saved[rgid]; ok {
+				masters[rgid] = m
+			}
+			continue
+		}
+		m := &Master{Address: ep.Address, Port: ep.Port, Priority: ep.Priority}
+		if old, ok := saved[rgid]; !ok || *old != *m {
+			r.hl.Infof("master of rgid %d is %s:%s", rgid, m.Address, m.Port)
+			changed = true
+		}
+		masters[rgid] = m
+	}
+	if len(masters) != len(saved) {
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+
+	mastersj, err := json.Marshal(masters)
+	if err != nil {
+		return err
+	}
+	// CAS: don't resurrect masters pruned by concurrent PutRepGroups, which
+	// might also have removed repgroups after we read them; and don't write
+	// if maintenance started after the watch told us
+	path := filepath.Join(r.cs.StorePath, "masters")
+	rgsPath := filepath.Join(r.cs.StorePath, "repgroups")
+	var guards = map[string]uint64{path: 0, rgsPath: 0}
+	if pair != nil {
+		guards[path] = pair.LastIndex
+	}
+	if rgpair != nil {
+		guards[rgsPath] = rgpair.LastIndex
+	}
+	err = r.cs.putGuarded(ctx, []store.Op{{Key: path, Value: mastersj}}, guards)
+	if err == store.ErrKeyModified {
+		return nil // someone else did the job, or we will retry next time
+	}
+	return err
+}
+
+// Stored master of repgroup vs the one Stolon reports now. Stored is nil if
+// there is no saved master; Live is nil if Stolon couldn't tell, then Error
+// says why.
+type MasterDrift struct {
+	Stored *Master
+	Live   *Master
+	Error  string `json:",omitempty"`
+}
+
+// Compare saved masters with current ones from Stolon without saving
+// anything, e.g. to alert when masters reconciler is behind or not running.
+// Only repgroups whose saved master is stale or whose Stolon store couldn't
+// be queried are returned.
+func (cs *ClusterStore) DetectMasterDrift(ctx context.Context) (map[int]MasterDrift, error) {
+	rgs, _, err := cs.GetRepGroups(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get repgroups: %v", err)
+	}
+	saved, _, err := cs.GetMasters(ctx)
+	if _, ok := err.(*MastersCorruptError); err != nil && !ok {
+		return nil, fmt.Errorf("Failed to get masters: %v", err)
+	}
+
+	var drift = make(map[int]MasterDrift)
+	for rgid, rg := range rgs {
+		var ep *Endpoint
+		ss, release, err := cs.getStolonStore(rg)
+		if err == nil {
+			ep, err = ss.GetMaster(ctx)
+			release()
+		}
+		if err == nil && ep == nil {
+			err = fmt.Errorf("no master")
+		}
+		if err != nil {
+			drift[rgid] = MasterDrift{Stored: saved[rgid], Error: err.Error()}
+			continue
+		}
+		live := &Master{Address: ep.Address, Port: ep.Port, Priority: ep.Priority}
+		if old, ok := saved[rgid]; !ok || old == nil || *old != *live {
+			drift[rgid] = MasterDrift{Stored: saved[rgid], Live: live}
+		}
+	}
+	return drift, nil
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2019, Postgres Professional
+
+// choosing replicas for read-only connections
+package cluster
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+)
+
+type ReplicaUnavailableError struct{}
+
+func (rue ReplicaUnavailableError) Error() string {
+	return "no healthy replicas found"
+}
+
+// Get su connstr for one of healthy standbys of this rg as map of libpq
+// options + its endpoint. Standby is chosen randomly according to
+// rg.ReplicaWeights, so successive calls spread the load. rnd is the source of
+// randomness; if nil, global math/rand is used. Pass rand.New with fixed seed
+// to get deterministic sequence. If there is no suitable standby, returns
+// ReplicaUnavailableError.
+func (cs *ClusterStore) GetReplicaConnstrMap(ctx context.Context, rg *RepGroup, cldata *ClusterData, rnd *rand.Rand) (map[string]string, *Endpoint, error) {
+	ss, release, err := cs.getStolonStore(rg)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
+
+	standbys, err := ss.GetStandbys(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	ep := chooseReplica(standbys, rg.ReplicaWeights, rnd)
+	if ep == nil {
+		return nil, nil, ReplicaUnavailableError{}
+	}
+	cp := suConnstrMap(cldata, rg, ep)
+	if err = ValidateConnOptions(cp); err != nil {
+		return nil, nil, err
+	}
+	return cp, ep, nil
+}
+
+// weighted random choice; nil if there is nothing to choose from
+func chooseReplica(standbys map[string]*Endpoint, weights map[string]int, rnd *rand.Rand) *Endpoint {
+	// map order is random, sort to make choice depend only on rnd
+	var uids = make([]string, 0, len(standbys))
+	for uid, _ := range standbys {
+		uids = append(uids, uid)
+	}
+	sort.Strings(uids)
+
+	var total = 0
+	for _, uid := range uids {
+		total += replicaWeight(weights, uid)
+	}
+	if total == 0 {
+		return nil
+	}
+	var r int
+	if rnd != nil {
+		r = rnd.Intn(total)
+	} else {
+		r = rand.Intn(total)
+	}
+	for _, uid := range uids {
+		r -= replicaWeight(weights, uid)
+		if r < 0 {
+			return standbys[uid]
+		}
+	}
+	return nil // not reached
+}
+
+func replicaWeight(weights map[string]int, uid string) int {
+	w, ok := weights[uid]
+	if !ok {
+		return 1
+	}
+	if w < 0 {
+		return 0
+	}
+	return w
+}
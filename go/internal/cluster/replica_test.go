@@ -0,0 +1,100 @@
+// Copyright (c) 2019, Postgres Professional
+
+package cluster
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func testStandbys() map[string]*Endpoint {
+	return map[string]*Endpoint{
+		"a": &Endpoint{Address: "10.0.0.1", Port: "5432"},
+		"b": &Endpoint{Address: "10.0.0.2", Port: "5432"},
+		"c": &Endpoint{Address: "10.0.0.3", Port: "5432"},
+	}
+}
+
+func chooseReplicaSequence(standbys map[string]*Endpoint, weights map[string]int, rnd *rand.Rand, n int) []string {
+	var seq []string
+	for i := 0; i < n; i++ {
+		ep := chooseReplica(standbys, weights, rnd)
+		if ep == nil {
+			seq = append(seq, "")
+			continue
+		}
+		seq = append(seq, ep.Address)
+	}
+	return seq
+}
+
+func TestChooseReplicaSeeded(t *testing.T) {
+	// math/rand sequence for a given seed is stable across Go releases
+	var want = []string{"10.0.0.3", "10.0.0.1", "10.0.0.3", "10.0.0.3", "10.0.0.2",
+		"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.2", "10.0.0.1"}
+	got := chooseReplicaSequence(testStandbys(), nil, rand.New(rand.NewSource(1)), len(want))
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected sequence %v, got %v", want, got)
+		}
+	}
+	// and it doesn't depend on map iteration order
+	for i := 0; i < 10; i++ {
+		again := chooseReplicaSequence(testStandbys(), nil, rand.New(rand.NewSource(1)), len(want))
+		for j := range got {
+			if again[j] != got[j] {
+				t.Fatalf("sequence with the same seed differs: %v vs %v", got, again)
+			}
+		}
+	}
+}
+
+func TestChooseReplicaZeroWeight(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	weights := map[string]int{"b": 0, "c": -1}
+	for i, addr := range chooseReplicaSequence(testStandbys(), weights, rnd, 1000) {
+		if addr != "10.0.0.1" {
+			t.Fatalf("choice %d: expected only 10.0.0.1, got %q", i, addr)
+		}
+	}
+	weights = map[string]int{"a": 0, "b": 0, "c": 0}
+	if ep := chooseReplica(testStandbys(), weights, rnd); ep != nil {
+		t.Errorf("expected no replica when all weights are 0, got %v", ep)
+	}
+	if ep := chooseReplica(map[string]*Endpoint{}, nil, rnd); ep != nil {
+		t.Errorf("expected no replica without standbys, got %v", ep)
+	}
+}
+
+func TestChooseReplicaSpread(t *testing.T) {
+	const n = 3000
+	var tests = []struct {
+		name    string
+		weights map[string]int
+		want    map[string]int // expected share of n, in thirds
+	}{
+		{"default", nil, map[string]int{"10.0.0.1": 1, "10.0.0.2": 1, "10.0.0.3": 1}},
+		{"even", map[string]int{"a": 5, "b": 5, "c": 5}, map[string]int{"10.0.0.1": 1, "10.0.0.2": 1, "10.0.0.3": 1}},
+		{"uneven", map[string]int{"a": 2, "b": 1, "c": 0}, map[string]int{"10.0.0.1": 2, "10.0.0.2": 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rnd := rand.New(rand.NewSource(1))
+			var counts = make(map[string]int)
+			for _, addr := range chooseReplicaSequence(testStandbys(), tt.weights, rnd, n) {
+				counts[addr]++
+			}
+			for addr, count := range counts {
+				expected := tt.want[addr] * n / 3
+				if count < expected*9/10 || count > expected*11/10 {
+					t.Errorf("%s chosen %d times of %d, expected about %d", addr, count, n, expected)
+				}
+			}
+			for addr, _ := range tt.want {
+				if counts[addr] == 0 {
+					t.Errorf("%s never chosen", addr)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright (c) 2019, Postgres Professional
+
+// restricting visible repgroups, e.g. to those of one tenant
+package cluster
+
+import (
+	"errors"
+)
+
+// Returned by operations which need to see all repgroups when store has
+// repgroup filter set
+var ErrRepGroupsFiltered = errors.New("operation is not allowed with repgroup filter set")
+
+// Make GetRepGroups, GetMasters, RepGroupsExist and their watch counterparts
+// (and everything built on top of them) see only repgroups for which filter
+// returns true. Writing repgroups and masters, UpdateStolonSpec and raw
+// snapshots of the store fail with ErrRepGroupsFiltered then, since they
+// would lose or expose hidden repgroups. nil removes the filter. Must be
+// called before the store is used concurrently.
+func (cs *ClusterStore) SetRepGroupFilter(filter func(rgid int) bool) {
+	cs.repGroupFilter = filter
+}
+
+func (cs *ClusterStore) filterRepGroups(rgs map[int]*RepGroup) map[int]*RepGroup {
+	if cs.repGroupFilter == nil || rgs == nil {
+		return rgs
+	}
+	var res = make(map[int]*RepGroup)
+	for rgid, rg := range rgs {
+		if cs.repGroupFilter(rgid) {
+			res[rgid] = rg
+		}
+	}
+	return res
+}
+
+func (cs *ClusterStore) filterMasters(masters map[int]*Master) map[int]*Master {
+	if cs.repGroupFilter == nil || masters == nil {
+		return masters
+	}
+	var res = make(map[int]*Master)
+	for rgid, master := range masters {
+		if cs.repGroupFilter(rgid) {
+			res[rgid] = master
+		}
+	}
+	return res
+}
+
+func (cs *ClusterStore) checkUnfiltered() error {
+	if cs.repGroupFilter != nil {
+		return ErrRepGroupsFiltered
+	}
+	return nil
+}
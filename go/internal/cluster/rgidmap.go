@@ -0,0 +1,86 @@
+// Copyright (c) 2019, Postgres Professional
+
+// json (de)serialization of rgid-keyed maps
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// json object keys are strings. encoding/json marshals int keys canonically
+// (strconv.Itoa), but on unmarshal happily accepts e.g. "010" or "+10", so
+// two different keys might silently collapse into one rgid. Keys we read must
+// be exactly what we would have written.
+func parseRgidKey(key string) (int, error) {
+	rgid, err := strconv.Atoi(key)
+	if err != nil || strconv.Itoa(rgid) != key {
+		return 0, fmt.Errorf("invalid rgid key %q", key)
+	}
+	return rgid, nil
+}
+
+// decode json object with rgid keys, calling decode for each entry. Returns
+// false if data is json null.
+func unmarshalRgidMap(data []byte, decode func(rgid int, raw json.RawMessage) error) (bool, error) {
+	var raws map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raws); err != nil {
+		return false, err
+	}
+	if raws == nil {
+		return false, nil
+	}
+	for key, raw := range raws {
+		rgid, err := parseRgidKey(key)
+		if err != nil {
+			return false, err
+		}
+		if err = decode(rgid, raw); err != nil {
+			return false, fmt.Errorf("rgid %d: %v", rgid, err)
+		}
+	}
+	return true, nil
+}
+
+func unmarshalRepGroups(data []byte) (map[int]*RepGroup, error) {
+	var rgs = make(map[int]*RepGroup)
+	notnull, err := unmarshalRgidMap(data, func(rgid int, raw json.RawMessage) error {
+		var rg *RepGroup
+		err := json.Unmarshal(raw, &rg)
+		rgs[rgid] = rg
+		return err
+	})
+	if err != nil || !notnull {
+		return nil, err
+	}
+	return rgs, nil
+}
+
+func unmarshalMasters(data []byte) (map[int]*Master, error) {
+	var masters = make(map[int]*Master)
+	notnull, err := unmarshalRgidMap(data, func(rgid int, raw json.RawMessage) error {
+		var master *Master
+		err := json.Unmarshal(raw, &master)
+		masters[rgid] = master
+		return err
+	})
+	if err != nil || !notnull {
+		return nil, err
+	}
+	return masters, nil
+}
+
+func unmarshalVersions(data []byte) (map[int]int, error) {
+	var versions = make(map[int]int)
+	notnull, err := unmarshalRgidMap(data, func(rgid int, raw json.RawMessage) error {
+		var version int
+		err := json.Unmarshal(raw, &version)
+		versions[rgid] = version
+		return err
+	})
+	if err != nil || !notnull {
+		return nil, err
+	}
+	return versions, nil
+}
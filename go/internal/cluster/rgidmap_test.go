@@ -0,0 +1,74 @@
+// Copyright (c) 2019, Postgres Professional
+
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+var testRgids = []int{0, 10, 100}
+
+func TestMastersRoundTrip(t *testing.T) {
+	var masters = make(map[int]*Master)
+	for _, rgid := range testRgids {
+		masters[rgid] = &Master{Address: fmt.Sprintf("10.0.0.%d", rgid), Port: "5432", Priority: rgid}
+	}
+	data, err := json.Marshal(masters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := unmarshalMasters(data)
+	if err != nil {
+		t.Fatalf("failed to unmarshal %s: %v", data, err)
+	}
+	if !reflect.DeepEqual(got, masters) {
+		t.Errorf("%s unmarshalled as %v, expected %v", data, got, masters)
+	}
+}
+
+func TestRepGroupsRoundTrip(t *testing.T) {
+	var rgs = make(map[int]*RepGroup)
+	for _, rgid := range testRgids {
+		rgs[rgid] = &RepGroup{StolonName: fmt.Sprintf("rg%d", rgid), StorePrefix: "stolon/cluster"}
+	}
+	data, err := json.Marshal(rgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := unmarshalRepGroups(data)
+	if err != nil {
+		t.Fatalf("failed to unmarshal %s: %v", data, err)
+	}
+	if !reflect.DeepEqual(got, rgs) {
+		t.Errorf("%s unmarshalled as %v, expected %v", data, got, rgs)
+	}
+}
+
+func TestRgidMapNull(t *testing.T) {
+	masters, err := unmarshalMasters([]byte("null"))
+	if err != nil || masters != nil {
+		t.Errorf("expected nil, nil for null, got %v, %v", masters, err)
+	}
+}
+
+func TestNonCanonicalRgidKeys(t *testing.T) {
+	var keys = []string{"010", "+1", "1e2", "-0", " 1", "1.0", "", "rg1",
+		"99999999999999999999", "-99999999999999999999"}
+	for _, key := range keys {
+		data := []byte(fmt.Sprintf(`{%q: {"Address": "10.0.0.1", "Port": "5432"}}`, key))
+		if masters, err := unmarshalMasters(data); err == nil {
+			t.Errorf("expected key %q to be rejected, got %v", key, masters)
+		}
+		data = []byte(fmt.Sprintf(`{%q: {"StolonName": "rg"}}`, key))
+		if rgs, err := unmarshalRepGroups(data); err == nil {
+			t.Errorf("expected key %q to be rejected, got %v", key, rgs)
+		}
+		data = []byte(fmt.Sprintf(`{%q: 110000}`, key))
+		if versions, err := unmarshalVersions(data); err == nil {
+			t.Errorf("expected key %q to be rejected, got %v", key, versions)
+		}
+	}
+}
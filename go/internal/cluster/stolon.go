@@ -25,6 +25,8 @@ import (
 type StolonStore struct {
 	storePath string
 	store     store.EtcdV3Store
+	// if not 0, all reads are performed at this store revision
+	pinnedRevision int64
 }
 
 func NewStolonStore(rg *RepGroup) (*StolonStore, error) {
@@ -83,8 +85,15 @@ type DB struct {
 type DBSpec struct {
 	// The KeeperUID this db is assigned to
 	KeeperUID string `json:"keeperUID,omitempty"`
+	// master or standby
+	Role string `json:"role,omitempty"`
 }
 type DBStatus struct {
+	Healthy bool `json:"healthy,omitempty"`
+	// Despite the name, this is the address advertised to clients: keeper
+	// publishes its --pg-advertise-address here (which defaults to
+	// --pg-listen-address). The address Postgres actually binds to is not
+	// published anywhere in the store.
 	ListenAddress string `json:"listenAddress,omitempty"`
 	Port          string `json:"port,omitempty"`
 }
@@ -101,18 +110,53 @@ type Proxy struct {
 	Status map[string]*ProxyStatus `json:"status,omitempty"`
 }
 
-// Master connection info
+// Master connection info. For dbs, Address is the advertised one (see
+// DBStatus), which is what clients must use.
 type Endpoint struct {
 	Address  string
 	Port     string
 	Priority int
+	// taken from masters key as Stolon store was unavailable, might be
+	// outdated
+	Stale bool
+}
+
+// Pin all subsequent reads to the current store revision, so that e.g.
+// repeated GetMaster calls during multi-step operation return the same master
+// even if failover happens meanwhile. Returns pinned revision.
+func (ss *StolonStore) Pin(ctx context.Context) (int64, error) {
+	rev, err := ss.store.GetRevision(ctx)
+	if err != nil {
+		return 0, err
+	}
+	ss.pinnedRevision = rev
+	return rev, nil
+}
+
+// Pin reads to given revision, e.g. obtained from another StolonStore's Pin.
+// 0 unpins.
+func (ss *StolonStore) PinRevision(rev int64) {
+	ss.pinnedRevision = rev
+}
+
+func (ss *StolonStore) Unpin() {
+	ss.pinnedRevision = 0
 }
 
 func (ss *StolonStore) GetClusterData(ctx context.Context) (*StolonClusterData, error) {
 	var clusterData StolonClusterData
+	var pair *store.KVPair
+	var err error
 
 	path := filepath.Join(ss.storePath, "clusterdata")
-	pair, err := ss.store.Get(ctx, path)
+	if ss.pinnedRevision != 0 {
+		pair, err = ss.store.GetAtRevision(ctx, path, ss.pinnedRevision)
+		if err == store.ErrCompacted {
+			return nil, fmt.Errorf("pinned Stolon store revision %d is no longer available", ss.pinnedRevision)
+		}
+	} else {
+		pair, err = ss.store.Get(ctx, path)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -135,15 +179,19 @@ func (ss *StolonStore) GetMaster(ctx context.Context) (*Endpoint, error) {
 	if clusterData == nil {
 		return nil, nil
 	}
+	return clusterData.master(), nil
+}
 
+// nil if there is no master
+func (clusterData *StolonClusterData) master() *Endpoint {
 	var master = &Endpoint{}
 	if db, ok := clusterData.DBs[clusterData.Proxy.Spec.MasterDBUID]; ok {
 		master.Address = db.Status.ListenAddress
 		master.Port = db.Status.Port
 		master.Priority = clusterData.Keepers[db.Spec.KeeperUID].Spec.Priority
-		return master, nil
+		return master
 	} else {
-		return nil, nil
+		return nil
 	}
 }
 
@@ -189,6 +237,57 @@ func (ss *StolonStore) GetProxy(ctx context.Context, singleEP bool) (*Endpoint,
 	return ep, nil
 }
 
+// Get healthy standbys, keeper uid -> endpoint. If there is no cluster (but
+// store is ok), returns nil, nil.
+func (ss *StolonStore) GetStandbys(ctx context.Context) (map[string]*Endpoint, error) {
+	clusterData, err := ss.GetClusterData(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if clusterData == nil {
+		return nil, nil
+	}
+
+	var standbys = make(map[string]*Endpoint)
+	for dbuid, db := range clusterData.DBs {
+		if dbuid == clusterData.Proxy.Spec.MasterDBUID || db.Spec == nil ||
+			db.Spec.Role != "standby" || !db.Status.Healthy {
+			continue
+		}
+		standbys[db.Spec.KeeperUID] = &Endpoint{
+			Address:  db.Status.ListenAddress,
+			Port:     db.Status.Port,
+			Priority: clusterData.Keepers[db.Spec.KeeperUID].Spec.Priority,
+		}
+	}
+	return standbys, nil
+}
+
+// Get all dbs Stolon knows about, db uid -> endpoint, regardless of their
+// role and health. If there is no cluster (but store is ok), returns nil, nil.
+func (ss *StolonStore) GetDBs(ctx context.Context) (map[string]*Endpoint, error) {
+	clusterData, err := ss.GetClusterData(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if clusterData == nil {
+		return nil, nil
+	}
+
+	var dbs = make(map[string]*Endpoint)
+	for dbuid, db := range clusterData.DBs {
+		if db.Status.ListenAddress == "" {
+			continue // not started yet
+		}
+		var ep = &Endpoint{Address: db.Status.ListenAddress, Port: db.Status.Port}
+		if db.Spec != nil {
+			ep.Priority = clusterData.Keepers[db.Spec.KeeperUID].Spec.Priority
+		}
+		dbs[dbuid] = ep
+	}
+	return dbs, nil
+}
+
 func (ss *StolonStore) Close() error {
 	return ss.store.Close()
 }
@@ -258,6 +357,60 @@ func StolonUpdate(hpc *StoreConnInfo, rg *RepGroup, rgid int, patch bool, spec *
 	return nil
 }
 
+// Get effective Stolon spec of repgroup with unset fields filled by defaults
+// of installed stolonctl (stolonctl spec --defaults), field -> json value
+func StolonSpecWithDefaults(hpc *StoreConnInfo, rg *RepGroup) (map[string]json.RawMessage, error) {
+	cmdargs := getConnArgs(hpc, rg)
+	cmdargs = append(cmdargs, "--cluster-name", rg.StolonName, "--store-prefix", rg.StorePrefix)
+	cmdargs = append(cmdargs, "spec", "--defaults")
+	cmd := exec.Command("stolonctl", cmdargs...)
+	stdout, err := cmd.Output()
+	if err != nil {
+		var stderr []byte
+		if ee, ok := err.(*exec.ExitError); ok {
+			stderr = ee.Stderr
+		}
+		return nil, fmt.Errorf("stolonctl spec failed, stderr: %s, err: %s",
+			string(stderr), err.Error())
+	}
+	var spec map[string]json.RawMessage
+	if err = json.Unmarshal(stdout, &spec); err != nil {
+		return nil, fmt.Errorf("failed to parse stolonctl spec output: %v", err)
+	}
+	return spec, nil
+}
+
+// Which top-level fields of StolonSpec are set explicitly and which are
+// inherited from Stolon defaults
+type StolonSpecDefaultsDiff struct {
+	Explicit  map[string]json.RawMessage // our values
+	Inherited map[string]json.RawMessage // default values
+}
+
+// Compare spec with effective one (see StolonSpecWithDefaults). Note that
+// effective spec contains our values for explicitly set fields, so we can't
+// tell whether explicit value happens to be equal to the default.
+func DiffStolonSpecDefaults(spec *StolonSpec, effective map[string]json.RawMessage) (*StolonSpecDefaultsDiff, error) {
+	specj, err := json.Marshal(spec)
+	if err != nil {
+		return nil, err
+	}
+	var explicit map[string]json.RawMessage
+	if err = json.Unmarshal(specj, &explicit); err != nil {
+		return nil, err
+	}
+	var diff = &StolonSpecDefaultsDiff{
+		Explicit:  explicit,
+		Inherited: make(map[string]json.RawMessage),
+	}
+	for field, value := range effective {
+		if _, ok := explicit[field]; !ok {
+			diff.Inherited[field] = value
+		}
+	}
+	return diff, nil
+}
+
 // And this time too
 func StolonInit(hpc *StoreConnInfo, rg *RepGroup, spec *StolonSpec, stolonBinPath string) error {
 	specj, err := json.Marshal(spec)
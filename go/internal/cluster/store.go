@@ -4,14 +4,20 @@
 package cluster
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	etcdclientv3 "go.etcd.io/etcd/clientv3"
+	"google.golang.org/grpc"
 	"k8s.io/apimachinery/pkg/util/strategicpatch"
 
 	"postgrespro.ru/shardman/internal/store"
@@ -23,12 +29,42 @@ type ClusterStore struct {
 	StorePath   string
 	Store       store.EtcdV3Store
 	ClusterName string // mainly for logging
+	encrypter   Encrypter
+	// see SetRepGroupFilter
+	repGroupFilter func(rgid int) bool
+	// see EnableMasterCache
+	masterCache *masterCache
 }
 
 type ClusterStoreConnInfo struct {
 	ClusterName    string
 	StoreConnInfo  StoreConnInfo
 	RequestTimeout int // in seconds
+	// Disaster recovery store, used when the primary one is unavailable. If
+	// Endpoints is "", there is no such store. If no TLS files are
+	// specified, ones of StoreConnInfo are used.
+	FallbackStoreConnInfo StoreConnInfo
+	// By default, fallback store is used only for reads
+	FallbackWrites bool
+	// If not 0, requests fail fast for BreakerCooldown seconds after that
+	// many consecutive store unavailability errors
+	BreakerThreshold int
+	BreakerCooldown  int
+	// Extra grpc options for etcd clients of shardman and fallback stores,
+	// applied after the ones etcd sets itself and thus overriding them.
+	// Safe to override:
+	//   - grpc.WithDialer, e.g. to go through proxy. Dialer gets host:port
+	//     of the endpoint; note that etcd's own dialer also reports dial
+	//     errors to client, which are then lost;
+	//   - grpc.WithKeepaliveParams, grpc.WithUserAgent, message size and
+	//     backoff settings.
+	// Not safe: grpc.WithInsecure and grpc.WithTransportCredentials (use
+	// https endpoints and TLS files instead), grpc.WithBalancer (etcd
+	// client relies on its own), grpc.WithBlock.
+	DialOptions []grpc.DialOption
+	// If not "", passwords in cluster data are encrypted with hex-encoded
+	// AES key from this file, see SetEncrypter
+	EncryptionKeyFile string
 }
 
 type StoreConnInfo struct {
@@ -39,15 +75,15 @@ type StoreConnInfo struct {
 	Key      string // client's private key
 }
 
-func NewClusterStore(cfg *ClusterStoreConnInfo) (*ClusterStore, error) {
-	endpoints := strings.Split(cfg.StoreConnInfo.Endpoints, ",")
+func newEtcdClient(ci *StoreConnInfo, dialOptions []grpc.DialOption) (*etcdclientv3.Client, error) {
+	endpoints := strings.Split(ci.Endpoints, ",")
 
 	var tlsConfig *tls.Config = nil
 	var err error
 	for _, endp := range endpoints {
 		if strings.HasPrefix(endp, "https") {
-			tlsConfig, err = tlswrap.NewTLSConfig(cfg.StoreConnInfo.CertFile, cfg.StoreConnInfo.Key,
-				cfg.StoreConnInfo.CAFile, false)
+			tlsConfig, err = tlswrap.NewTLSConfig(ci.CertFile, ci.Key,
+				ci.CAFile, false)
 			if err != nil {
 				return nil, fmt.Errorf("cannot create store tls config: %v", err)
 
@@ -56,19 +92,53 @@ func NewClusterStore(cfg *ClusterStoreConnInfo) (*ClusterStore, error) {
 		}
 	}
 
-	cli, err := etcdclientv3.New(etcdclientv3.Config{
-		Endpoints: endpoints,
-		TLS:       tlsConfig,
+	return etcdclientv3.New(etcdclientv3.Config{
+		Endpoints:   endpoints,
+		TLS:         tlsConfig,
+		DialOptions: dialOptions,
 	})
+}
+
+func NewClusterStore(cfg *ClusterStoreConnInfo) (*ClusterStore, error) {
+	cli, err := newEtcdClient(&cfg.StoreConnInfo, cfg.DialOptions)
 	if err != nil {
 		return nil, err
 	}
 	etcdstore := store.NewEtcdV3StoreWithTimout(cli, cfg.RequestTimeout)
+
+	if cfg.FallbackStoreConnInfo.Endpoints != "" {
+		fci := cfg.FallbackStoreConnInfo
+		if fci.CAFile == "" && fci.CertFile == "" && fci.Key == "" {
+			fci.CAFile = cfg.StoreConnInfo.CAFile
+			fci.CertFile = cfg.StoreConnInfo.CertFile
+			fci.Key = cfg.StoreConnInfo.Key
+		}
+		fcli, err := newEtcdClient(&fci, cfg.DialOptions)
+		if err != nil {
+			cli.Close()
+			return nil, fmt.Errorf("failed to create fallback store client: %v", err)
+		}
+		etcdstore.SetFallback(fcli, cfg.FallbackWrites)
+	}
+
+	etcdstore.SetCircuitBreaker(cfg.BreakerThreshold, time.Duration(cfg.BreakerCooldown)*time.Second)
+
 	storePath := filepath.Join("shardman", cfg.ClusterName)
-	return &ClusterStore{StorePath: storePath, Store: etcdstore, ClusterName: cfg.ClusterName}, nil
+	cs := &ClusterStore{StorePath: storePath, Store: etcdstore, ClusterName: cfg.ClusterName}
+	if cfg.EncryptionKeyFile != "" {
+		e, err := NewAESGCMEncrypterFromFile(cfg.EncryptionKeyFile)
+		if err != nil {
+			cs.Close()
+			return nil, fmt.Errorf("failed to load encryption key: %v", err)
+		}
+		cs.SetEncrypter(e)
+	}
+	return cs, nil
 }
 
 // Get global cluster data
+// Read is linearizable unless other level is set in ctx with
+// store.WithReadConsistency; the same holds for all other getters.
 func (cs *ClusterStore) GetClusterData(ctx context.Context) (*ClusterData, *store.KVPair, error) {
 	var cldata = &ClusterData{}
 	path := filepath.Join(cs.StorePath, "clusterdata")
@@ -82,17 +152,181 @@ func (cs *ClusterStore) GetClusterData(ctx context.Context) (*ClusterData, *stor
 	if err := json.Unmarshal(pair.Value, cldata); err != nil {
 		return nil, nil, err
 	}
+	if err := cs.decryptClusterData(cldata); err != nil {
+		return nil, nil, err
+	}
 	return cldata, pair, nil
 }
 
-// Put global cluster data
+// Put global cluster data. If stolon spec changes or ChangeMeta is attached to
+// ctx, the (new) spec is recorded in spec history along with ChangeMeta in the
+// same transaction. Fails with ErrMaintenanceMode if cluster is in maintenance
+// mode.
 func (cs *ClusterStore) PutClusterData(ctx context.Context, cldata *ClusterData) error {
-	cldataj, err := json.Marshal(cldata)
+	return cs.putClusterData(ctx, cldata, nil)
+}
+
+// Same as PutClusterData, but only if cluster data wasn't modified since
+// previous was read. Returns store.ErrKeyModified otherwise.
+func (cs *ClusterStore) AtomicPutClusterData(ctx context.Context, cldata *ClusterData, previous *store.KVPair) error {
+	return cs.putClusterData(ctx, cldata, previous)
+}
+
+// how many times to retry cluster data put if spec history is concurrently
+// modified
+const putClusterDataMaxAttempts = 5
+
+func (cs *ClusterStore) putClusterData(ctx context.Context, cldata *ClusterData, previous *store.KVPair) error {
+	enc, err := cs.encryptClusterData(cldata)
+	if err != nil {
+		return err
+	}
+	cldataj, err := json.Marshal(enc)
 	if err != nil {
 		return err
 	}
 	path := filepath.Join(cs.StorePath, "clusterdata")
-	return cs.Store.Put(ctx, path, cldataj)
+	historyPath := filepath.Join(cs.StorePath, "spechistory")
+
+	for attempt := 1; ; attempt++ {
+		var ops = []store.Op{{Key: path, Value: cldataj}}
+		var guards = map[string]uint64{}
+
+		// spec we are replacing: the one we were given or, for blind
+		// put, the current one, which is then guarded as well
+		var prevValue []byte
+		if previous != nil {
+			guards[path] = previous.LastIndex
+			prevValue = previous.Value
+		} else {
+			cur, err := cs.Store.Get(ctx, path)
+			if err != nil {
+				return err
+			}
+			guards[path] = 0
+			if cur != nil {
+				guards[path] = cur.LastIndex
+				prevValue = cur.Value
+			}
+		}
+		changed, err := stolonSpecChanged(prevValue, &cldata.Spec.StolonSpec)
+		if err != nil {
+			return err
+		}
+		// tagged changes are recorded even if they don't touch stolon
+		// spec, for audit
+		if changed || changeMetaFromContext(ctx) != nil {
+			historyj, hpair, err := cs.appendSpecHistory(ctx, &cldata.Spec.StolonSpec)
+			if err != nil {
+				return fmt.Errorf("failed to record spec history: %v", err)
+			}
+			ops = append(ops, store.Op{Key: historyPath, Value: historyj})
+			guards[historyPath] = 0
+			if hpair != nil {
+				guards[historyPath] = hpair.LastIndex
+			}
+		}
+
+		err = cs.putGuarded(ctx, ops, guards)
+		if err != store.ErrKeyModified || attempt == putClusterDataMaxAttempts {
+			return err
+		}
+		if previous != nil {
+			// retry only if it was history that changed
+			cur, gerr := cs.Store.Get(ctx, path)
+			if gerr != nil || cur == nil || cur.LastIndex != previous.LastIndex {
+				return err
+			}
+		}
+	}
+}
+
+// Check whether stolon spec in marshalled cluster data prev differs from spec
+func stolonSpecChanged(prev []byte, spec *StolonSpec) (bool, error) {
+	if prev == nil {
+		return true, nil
+	}
+	var prevData ClusterData
+	if err := json.Unmarshal(prev, &prevData); err != nil {
+		// unreadable previous data, record anyway
+		return true, nil
+	}
+	prevj, err := json.Marshal(&prevData.Spec.StolonSpec)
+	if err != nil {
+		return false, err
+	}
+	specj, err := json.Marshal(spec)
+	if err != nil {
+		return false, err
+	}
+	return !bytes.Equal(prevj, specj), nil
+}
+
+// Who and why changes cluster data, for audit
+type ChangeMeta struct {
+	Actor  string
+	Reason string
+	Ticket string
+}
+
+type changeMetaKey struct{}
+
+// Attach change metadata to ctx; PutClusterData and UpdateStolonSpec will
+// record it in spec history.
+func WithChangeMeta(ctx context.Context, meta *ChangeMeta) context.Context {
+	return context.WithValue(ctx, changeMetaKey{}, meta)
+}
+
+func changeMetaFromContext(ctx context.Context) *ChangeMeta {
+	meta, _ := ctx.Value(changeMetaKey{}).(*ChangeMeta)
+	return meta
+}
+
+// how many latest spec changes we keep
+const specHistoryMaxLen = 100
+
+type SpecHistoryEntry struct {
+	Time       time.Time
+	Meta       *ChangeMeta // nil if not provided
+	StolonSpec StolonSpec
+}
+
+// Get spec changes log, oldest first
+func (cs *ClusterStore) GetSpecHistory(ctx context.Context) ([]*SpecHistoryEntry, *store.KVPair, error) {
+	var history []*SpecHistoryEntry
+	path := filepath.Join(cs.StorePath, "spechistory")
+	pair, err := cs.Store.Get(ctx, path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if pair == nil {
+		return []*SpecHistoryEntry{}, nil, nil
+	}
+	if err := json.Unmarshal(pair.Value, &history); err != nil {
+		return nil, nil, err
+	}
+	return history, pair, nil
+}
+
+// Marshal spec history with spec appended; returned pair is the history read
+func (cs *ClusterStore) appendSpecHistory(ctx context.Context, spec *StolonSpec) ([]byte, *store.KVPair, error) {
+	history, pair, err := cs.GetSpecHistory(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	history = append(history, &SpecHistoryEntry{
+		Time:       time.Now(),
+		Meta:       changeMetaFromContext(ctx),
+		StolonSpec: *spec,
+	})
+	if len(history) > specHistoryMaxLen {
+		history = history[len(history)-specHistoryMaxLen:]
+	}
+	historyj, err := json.Marshal(history)
+	if err != nil {
+		return nil, nil, err
+	}
+	return historyj, pair, nil
 }
 
 // Get all Stolons connection info
@@ -106,33 +340,274 @@ func (cs *ClusterStore) GetRepGroups(ctx context.Context) (map[int]*RepGroup, *s
 	if pair == nil {
 		return nil, nil, nil
 	}
-	if err := json.Unmarshal(pair.Value, &rgdata); err != nil {
+	if rgdata, err = unmarshalRepGroups(pair.Value); err != nil {
 		return nil, nil, err
 	}
-	return rgdata, pair, nil
+	return cs.filterRepGroups(rgdata), pair, nil
 }
 
-// Put replication groups info
+// Check existence of several repgroups with one read; pending repgroups are
+// reported as nonexistent, since nothing may be placed on them yet
+func (cs *ClusterStore) RepGroupsExist(ctx context.Context, rgids []int) (map[int]bool, error) {
+	allrgs, _, err := cs.GetRepGroups(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rgs := ReadyRepGroups(allrgs)
+	var res = make(map[int]bool, len(rgids))
+	for _, rgid := range rgids {
+		_, res[rgid] = rgs[rgid]
+	}
+	return res, nil
+}
+
+// how many times to retry PutRepGroups if masters are concurrently modified
+const putRepGroupsMaxAttempts = 5
+
+// Put replication groups info. Saved masters of repgroups not present in rgs
+// are removed in the same transaction. If masters data is corrupt, salvaged
+// entries are kept. Fails with ErrMaintenanceMode if cluster is in maintenance
+// mode.
 func (cs *ClusterStore) PutRepGroups(ctx context.Context, rgs map[int]*RepGroup) error {
+	if err := cs.checkUnfiltered(); err != nil {
+		return err
+	}
 	rgsj, err := json.Marshal(rgs)
 	if err != nil {
 		return err
 	}
 	path := filepath.Join(cs.StorePath, "repgroups")
-	return cs.Store.Put(ctx, path, rgsj)
+	mastersPath := filepath.Join(cs.StorePath, "masters")
+
+	for attempt := 1; ; attempt++ {
+		var ops = []store.Op{{Key: path, Value: rgsj}}
+		var guards = map[string]uint64{}
+
+		masters, mpair, err := cs.GetMasters(ctx)
+		if _, ok := err.(*MastersCorruptError); err != nil && !ok {
+			return fmt.Errorf("failed to get masters: %v", err)
+		}
+		var pruned = false
+		for rgid, _ := range masters {
+			if _, ok := rgs[rgid]; !ok {
+				delete(masters, rgid)
+				pruned = true
+			}
+		}
+		if pruned {
+			mastersj, err := json.Marshal(masters)
+			if err != nil {
+				return err
+			}
+			ops = append(ops, store.Op{Key: mastersPath, Value: mastersj})
+			guards[mastersPath] = mpair.LastIndex
+		}
+
+		err = cs.putGuarded(ctx, ops, guards)
+		if err != store.ErrKeyModified || attempt == putRepGroupsMaxAttempts {
+			return err
+		}
+	}
+}
+
+// Get saved PG versions (server_version_num) of repgroups
+func (cs *ClusterStore) GetRepGroupVersions(ctx context.Context) (map[int]int, *store.KVPair, error) {
+	var versions map[int]int
+	path := filepath.Join(cs.StorePath, "versions")
+	pair, err := cs.Store.Get(ctx, path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if pair == nil {
+		return map[int]int{}, nil, nil
+	}
+	if versions, err = unmarshalVersions(pair.Value); err != nil {
+		return nil, nil, err
+	}
+	return versions, pair, nil
+}
+
+// Save PG versions of repgroups. Fails with ErrMaintenanceMode if cluster is
+// in maintenance mode.
+func (cs *ClusterStore) PutRepGroupVersions(ctx context.Context, versions map[int]int) error {
+	return cs.putRepGroupVersions(ctx, versions, nil, false)
+}
+
+// Same as PutRepGroupVersions, but only if versions weren't modified since
+// previous was read (nil previous means they must not exist yet). Returns
+// store.ErrKeyModified otherwise.
+func (cs *ClusterStore) AtomicPutRepGroupVersions(ctx context.Context, versions map[int]int, previous *store.KVPair) error {
+	return cs.putRepGroupVersions(ctx, versions, previous, true)
+}
+
+func (cs *ClusterStore) putRepGroupVersions(ctx context.Context, versions map[int]int, previous *store.KVPair, atomic bool) error {
+	versionsj, err := json.Marshal(versions)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(cs.StorePath, "versions")
+	var guards map[string]uint64
+	if atomic {
+		guards = map[string]uint64{path: 0}
+		if previous != nil {
+			guards[path] = previous.LastIndex
+		}
+	}
+	return cs.putGuarded(ctx, []store.Op{{Key: path, Value: versionsj}}, guards)
+}
+
+// Cluster-wide feature flags defaults: flag not set in the store takes value
+// from here, and unknown flag is considered disabled.
+var FeatureFlagDefaults = map[string]bool{}
+
+// Get feature flags explicitly set in the store
+func (cs *ClusterStore) GetFeatureFlags(ctx context.Context) (map[string]bool, *store.KVPair, error) {
+	var flags map[string]bool
+	path := filepath.Join(cs.StorePath, "featureflags")
+	pair, err := cs.Store.Get(ctx, path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if pair == nil {
+		return map[string]bool{}, nil, nil
+	}
+	if err := json.Unmarshal(pair.Value, &flags); err != nil {
+		return nil, nil, err
+	}
+	return flags, pair, nil
 }
 
-// Save current masters for each repgroup
-// func (cs *ClusterStore) PutMasters(ctx context.Context, masters map[int]*Master) error {
-// mastersj, err := json.Marshal(masters)
-// if err != nil {
-// return err
-// }
-// path := filepath.Join(cs.StorePath, "masters")
-// return cs.Store.Put(ctx, path, mastersj)
-// }
+// Enable or disable feature flag. Flags are kept under one key, so CAS is
+// used to avoid losing concurrent changes of other flags.
+func (cs *ClusterStore) SetFeatureFlag(ctx context.Context, name string, enabled bool) error {
+	flags, pair, err := cs.GetFeatureFlags(ctx)
+	if err != nil {
+		return err
+	}
+	flags[name] = enabled
+	flagsj, err := json.Marshal(flags)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(cs.StorePath, "featureflags")
+	var guards = map[string]uint64{path: 0}
+	if pair != nil {
+		guards[path] = pair.LastIndex
+	}
+	err = cs.putGuarded(ctx, []store.Op{{Key: path, Value: flagsj}}, guards)
+	if err == store.ErrKeyModified {
+		return fmt.Errorf("feature flags were modified concurrently, please retry")
+	}
+	return err
+}
+
+// Whether feature is enabled, falling back to FeatureFlagDefaults
+func (cs *ClusterStore) IsFeatureEnabled(ctx context.Context, name string) (bool, error) {
+	flags, _, err := cs.GetFeatureFlags(ctx)
+	if err != nil {
+		return false, err
+	}
+	if enabled, ok := flags[name]; ok {
+		return enabled, nil
+	}
+	return FeatureFlagDefaults[name], nil
+}
+
+// Save current masters for each repgroup. Fails with ErrMaintenanceMode if
+// cluster is in maintenance mode.
+func (cs *ClusterStore) PutMasters(ctx context.Context, masters map[int]*Master) error {
+	if err := cs.checkUnfiltered(); err != nil {
+		return err
+	}
+	mastersj, err := json.Marshal(masters)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(cs.StorePath, "masters")
+	return cs.putGuarded(ctx, []store.Op{{Key: path, Value: mastersj}}, nil)
+}
+
+// Returned by GetMasters when stored masters can't be fully decoded. Salvaged
+// entries are returned along with it.
+type MastersCorruptError struct {
+	Corrupt   []string // keys of entries which failed to decode
+	Truncated bool     // json is broken, entries after the break are lost
+}
+
+func (mce *MastersCorruptError) Error() string {
+	msg := fmt.Sprintf("masters data is corrupt, broken entries: [%s]", strings.Join(mce.Corrupt, ", "))
+	if mce.Truncated {
+		msg += ", json is truncated"
+	}
+	return msg
+}
+
+// Get last saved masters of repgroups. If json is broken, valid entries are
+// salvaged and returned together with *MastersCorruptError.
+func (cs *ClusterStore) GetMasters(ctx context.Context) (map[int]*Master, *store.KVPair, error) {
+	var masters map[int]*Master
+	path := filepath.Join(cs.StorePath, "masters")
+	pair, err := cs.Store.Get(ctx, path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if pair == nil {
+		return nil, nil, nil
+	}
+	if masters, err = unmarshalMasters(pair.Value); err != nil {
+		masters, mce := salvageMasters(pair.Value)
+		return cs.filterMasters(masters), pair, mce
+	}
+	return cs.filterMasters(masters), pair, nil
+}
+
+// decode masters entry by entry, skipping undecodable ones
+func salvageMasters(data []byte) (map[int]*Master, *MastersCorruptError) {
+	var masters = make(map[int]*Master)
+	var mce = &MastersCorruptError{Corrupt: make([]string, 0)}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		mce.Truncated = true
+		return masters, mce
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			mce.Truncated = true
+			break
+		}
+		key, _ := tok.(string)
+		var raw json.RawMessage
+		if err = dec.Decode(&raw); err != nil {
+			mce.Corrupt = append(mce.Corrupt, key)
+			mce.Truncated = true
+			break
+		}
+		var master Master
+		rgid, err := parseRgidKey(key)
+		if err == nil {
+			err = json.Unmarshal(raw, &master)
+		}
+		if err != nil {
+			mce.Corrupt = append(mce.Corrupt, key)
+			continue
+		}
+		masters[rgid] = &master
+	}
+	// More() is also false at EOF, check closing brace is there
+	if !mce.Truncated {
+		if tok, err := dec.Token(); err != nil || tok != json.Delim('}') {
+			mce.Truncated = true
+		}
+	}
+	return masters, mce
+}
 
 func (cs *ClusterStore) Close() error {
+	if cs.masterCache != nil {
+		cs.masterCache.cancel()
+	}
 	return cs.Store.Close()
 }
 
@@ -153,16 +628,210 @@ func patchStolonSpec(spec *StolonSpec, patch []byte) (*StolonSpec, error) {
 	return newspec, nil
 }
 
-// Broadcast new stolon spec to all stolons and update it in store
-func (cs *ClusterStore) UpdateStolonSpec(ctx context.Context, hpc *StoreConnInfo, specdata []byte, patch bool) error {
-	cldata, _, err := cs.GetClusterData(ctx)
+// Check that applying empty patch to spec gives the same spec, i.e. neither
+// strategic merge patch nor struct tags lose or alter any field.
+func VerifyStolonSpecPatchRoundTrip(spec *StolonSpec) error {
+	return verifyPatchRoundTrip(spec)
+}
+
+// Same for any pointer to struct. Values are compared as is, not as json, so
+// fields json silently drops (e.g. with duplicate or "-" tag) are caught too;
+// but nil and empty slices and maps are considered equal, as omitempty doesn't
+// distinguish them.
+func verifyPatchRoundTrip(obj interface{}) error {
+	objj, err := json.Marshal(obj)
+	if err != nil {
+		return fmt.Errorf("failed to marshal: %v", err)
+	}
+	patchedj, err := strategicpatch.StrategicMergePatch(objj, []byte("{}"), obj)
+	if err != nil {
+		return fmt.Errorf("failed to merge patch: %v", err)
+	}
+	patched := reflect.New(reflect.TypeOf(obj).Elem())
+	if err := json.Unmarshal(patchedj, patched.Interface()); err != nil {
+		return fmt.Errorf("failed to unmarshal patched: %v", err)
+	}
+	if !semanticEqual(reflect.ValueOf(obj).Elem(), patched.Elem()) {
+		return fmt.Errorf("changed by empty patch: was %s, became %s", objj, patchedj)
+	}
+	return nil
+}
+
+func semanticEqual(a, b reflect.Value) bool {
+	switch a.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if a.IsNil() || b.IsNil() {
+			return a.IsNil() == b.IsNil()
+		}
+		return semanticEqual(a.Elem(), b.Elem())
+	case reflect.Struct:
+		for i := 0; i < a.NumField(); i++ {
+			if !semanticEqual(a.Field(i), b.Field(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Slice, reflect.Array:
+		if a.Len() != b.Len() {
+			return false
+		}
+		for i := 0; i < a.Len(); i++ {
+			if !semanticEqual(a.Index(i), b.Index(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Map:
+		if a.Len() != b.Len() {
+			return false
+		}
+		for _, key := range a.MapKeys() {
+			bv := b.MapIndex(key)
+			if !bv.IsValid() || !semanticEqual(a.MapIndex(key), bv) {
+				return false
+			}
+		}
+		return true
+	case reflect.Bool:
+		return a.Bool() == b.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return a.Int() == b.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return a.Uint() == b.Uint()
+	case reflect.Float32, reflect.Float64:
+		return a.Float() == b.Float()
+	case reflect.String:
+		return a.String() == b.String()
+	}
+	return false
+}
+
+// Returned by UpdateStolonSpec when Stolons got new spec, but cluster data was
+// modified concurrently and thus new spec is not saved in the store
+type SpecNotSavedError struct{}
+
+func (snse SpecNotSavedError) Error() string {
+	return "Stolons were updated, but stored spec was not as cluster data was modified concurrently; check the spec and retry"
+}
+
+// What UpdateStolonSpec checks before touching any Stolon
+type Preflight int
+
+const (
+	PreflightNone Preflight = iota
+	// Stolon stores of all repgroups are reachable
+	PreflightStore
+	// and all repgroups have healthy master
+	PreflightMaster
+)
+
+// Parse preflight level name: none, store or master
+func ParsePreflight(name string) (Preflight, error) {
+	switch name {
+	case "", "none":
+		return PreflightNone, nil
+	case "store":
+		return PreflightStore, nil
+	case "master":
+		return PreflightMaster, nil
+	}
+	return PreflightNone, fmt.Errorf("unknown preflight check %q", name)
+}
+
+// Returned by UpdateStolonSpec when preflight check failed; nothing was
+// changed then
+type PreflightError struct {
+	// rgid -> what is wrong
+	Unreachable map[int]string
+}
+
+func (pe PreflightError) Error() string {
+	var rgids = make([]int, 0, len(pe.Unreachable))
+	for rgid, _ := range pe.Unreachable {
+		rgids = append(rgids, rgid)
+	}
+	sort.Ints(rgids)
+	var msgs = make([]string, 0, len(rgids))
+	for _, rgid := range rgids {
+		msgs = append(msgs, fmt.Sprintf("repgroup %d: %s", rgid, pe.Unreachable[rgid]))
+	}
+	return "preflight check failed, nothing changed: " + strings.Join(msgs, "; ")
+}
+
+func (cs *ClusterStore) preflight(ctx context.Context, rgs map[int]*RepGroup, level Preflight) error {
+	if level == PreflightNone {
+		return nil
+	}
+	var pe = PreflightError{Unreachable: make(map[int]string)}
+	for rgid, rg := range rgs {
+		ss, release, err := cs.getStolonStore(rg)
+		if err != nil {
+			pe.Unreachable[rgid] = err.Error()
+			continue
+		}
+		clusterData, err := ss.GetClusterData(ctx)
+		release()
+		if err != nil {
+			pe.Unreachable[rgid] = fmt.Sprintf("Stolon store is unreachable: %v", err)
+			continue
+		}
+		if level < PreflightMaster {
+			continue
+		}
+		if clusterData == nil {
+			pe.Unreachable[rgid] = "Stolon cluster data not found"
+			continue
+		}
+		if db, ok := clusterData.DBs[clusterData.Proxy.Spec.MasterDBUID]; !ok || !db.Status.Healthy {
+			pe.Unreachable[rgid] = "no healthy master"
+		}
+	}
+	if len(pe.Unreachable) != 0 {
+		return pe
+	}
+	return nil
+}
+
+// Broadcast new stolon spec to all stolons and update it in store. ChangeMeta
+// attached to ctx is recorded in spec history. With preflight, all repgroups
+// are checked first, and if any check fails, PreflightError is returned
+// without changing anything.
+// If expectedRevision is not 0, cluster data must still have this revision
+// (LastIndex of GetClusterData pair), otherwise nothing is done and
+// store.ErrKeyModified is returned. In any case, final store update is CAS:
+// if cluster data was modified during broadcast, SpecNotSavedError is
+// returned.
+func (cs *ClusterStore) UpdateStolonSpec(ctx context.Context, hpc *StoreConnInfo, specdata []byte, patch bool, expectedRevision uint64, preflight Preflight) error {
+	// spec is cluster-wide, so it must reach all repgroups
+	if err := cs.checkUnfiltered(); err != nil {
+		return err
+	}
+	// check it before touching Stolons
+	mm, _, err := cs.GetMaintenanceMode(ctx)
 	if err != nil {
 		return err
 	}
+	if mm != nil {
+		return ErrMaintenanceMode
+	}
+	cldata, pair, err := cs.GetClusterData(ctx)
+	if err != nil {
+		return err
+	}
+	if cldata == nil {
+		return fmt.Errorf("cluster data not found")
+	}
+	if expectedRevision != 0 && pair.LastIndex != expectedRevision {
+		return store.ErrKeyModified
+	}
 
 	currentspec := &cldata.Spec.StolonSpec
 	var newspec *StolonSpec
 	if patch {
+		// otherwise patch would silently modify more than asked
+		if err = VerifyStolonSpecPatchRoundTrip(currentspec); err != nil {
+			return err
+		}
 		newspec, err = patchStolonSpec(currentspec, specdata)
 		if err != nil {
 			return err
@@ -180,6 +849,9 @@ func (cs *ClusterStore) UpdateStolonSpec(ctx context.Context, hpc *StoreConnInfo
 	if err != nil {
 		return err
 	}
+	if err = cs.preflight(ctx, rgs, preflight); err != nil {
+		return err
+	}
 	for rgid, rg := range rgs {
 		// we already patched if needed, just pass new spec. Defaults
 		// for unspecified values are set by Stolon.
@@ -189,7 +861,36 @@ func (cs *ClusterStore) UpdateStolonSpec(ctx context.Context, hpc *StoreConnInfo
 	}
 
 	cldata.Spec.StolonSpec = *newspec
-	return cs.PutClusterData(ctx, cldata)
+	err = cs.AtomicPutClusterData(ctx, cldata, pair)
+	if err == store.ErrKeyModified {
+		return SpecNotSavedError{}
+	}
+	return err
+}
+
+// Learn which fields of cluster's Stolon spec are set explicitly and which
+// come from defaults of Stolon running at repgroup rgid
+func (cs *ClusterStore) GetStolonSpecDefaultsDiff(ctx context.Context, hpc *StoreConnInfo, rgid int) (*StolonSpecDefaultsDiff, error) {
+	cldata, _, err := cs.GetClusterData(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if cldata == nil {
+		return nil, fmt.Errorf("cluster data not found")
+	}
+	rgs, _, err := cs.GetRepGroups(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rg, ok := rgs[rgid]
+	if !ok {
+		return nil, fmt.Errorf("repgroup %d not found", rgid)
+	}
+	effective, err := StolonSpecWithDefaults(hpc, rg)
+	if err != nil {
+		return nil, err
+	}
+	return DiffStolonSpecDefaults(&cldata.Spec.StolonSpec, effective)
 }
 
 type MasterUnavailableError struct{}
@@ -209,42 +910,298 @@ func (cs *ClusterStore) GetSuConnstrMap(ctx context.Context, rg *RepGroup, cldat
 // if singleEP is true, only one endpoint is returned even if multiple proxies are
 // available
 func (cs *ClusterStore) GetSuConnstrMapExtended(ctx context.Context, rg *RepGroup, cldata *ClusterData, directMaster bool, singleEP bool) (map[string]string, int, error) {
-	// if this rg has separate store, connect to it
-	var ss *StolonStore
-	if rg.StoreConnInfo.Endpoints != "" {
-		var err error
-		ss, err = NewStolonStore(rg)
-		if err != nil {
-			return nil, 0, err
+	cp, ep, err := cs.GetSuConnstrMapOpts(ctx, rg, cldata, &ConnstrOpts{
+		DirectMaster: directMaster,
+		SingleEP:     singleEP,
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return cp, ep.Priority, nil
+}
+
+// Determine coordinator repgroup, see ClusterSpec.CoordinatorRgid
+func CoordinatorRgid(cldata *ClusterData, rgs map[int]*RepGroup) (int, error) {
+	rgs = ReadyRepGroups(rgs)
+	if cldata.Spec.CoordinatorRgid != 0 {
+		if _, ok := rgs[cldata.Spec.CoordinatorRgid]; !ok {
+			return 0, fmt.Errorf("coordinator repgroup %d doesn't exist", cldata.Spec.CoordinatorRgid)
+		}
+		return cldata.Spec.CoordinatorRgid, nil
+	}
+	var coordinator = 0
+	for rgid, _ := range rgs {
+		if coordinator == 0 || rgid < coordinator {
+			coordinator = rgid
 		}
-		defer ss.Close()
-	} else {
-		// otherwise, use our
-		ss = NewStolonStoreFromExisting(rg, cs.Store)
 	}
+	if coordinator == 0 {
+		return 0, fmt.Errorf("no repgroups in cluster")
+	}
+	return coordinator, nil
+}
 
-	var err error
+// Get su connstr (as map of libpq options) of the coordinator repgroup
+func (cs *ClusterStore) GetCoordinatorConnstrMap(ctx context.Context) (map[string]string, error) {
+	cldata, _, err := cs.GetClusterData(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get cluster data: %v", err)
+	}
+	if cldata == nil {
+		return nil, fmt.Errorf("cluster data not found")
+	}
+	rgs, _, err := cs.GetRepGroups(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get repgroups: %v", err)
+	}
+	rgid, err := CoordinatorRgid(cldata, rgs)
+	if err != nil {
+		return nil, err
+	}
+	cp, _, err := cs.GetSuConnstrMapOpts(ctx, rgs[rgid], cldata, &ConnstrOpts{})
+	return cp, err
+}
+
+// Options of GetSuConnstrMapOpts
+type ConnstrOpts struct {
+	// always retrieve addresses of actual masters; otherwise, proxy
+	// addresses are returned if UseProxy is true
+	DirectMaster bool
+	// return only one endpoint even if multiple proxies are available
+	SingleEP bool
+	// If Stolon store of rg is unavailable, build connstr from master
+	// last saved in masters key (see MastersReconciler) instead of
+	// failing; returned Endpoint is marked as Stale then. Proxies are not
+	// saved, so it is always direct master connstr.
+	AllowStale bool
+	// If not empty, connstr refers to this libpq service instead of
+	// containing connection options directly. The service must be defined
+	// in pg_service.conf, e.g. with entry formed by pg.FormPgServiceEntry
+	// from connstr map retrieved without ServiceName.
+	ServiceName string
+}
+
+// Get current connstr for this rg as map of libpq options + endpoint of current
+// master (or proxies). If no master available, returns MasterUnavailableError.
+// Master address is the one advertised by Stolon keeper (--pg-advertise-address,
+// defaults to --pg-listen-address); if Postgres listens on an address not
+// reachable by clients (e.g. 0.0.0.0 or inside container), keeper must be
+// configured to advertise the right one. Listen address can't be chosen here
+// as Stolon doesn't publish it.
+func (cs *ClusterStore) GetSuConnstrMapOpts(ctx context.Context, rg *RepGroup, cldata *ClusterData, opts *ConnstrOpts) (map[string]string, *Endpoint, error) {
 	var ep *Endpoint
-	if directMaster || !cldata.Spec.UseProxy {
-		ep, err = ss.GetMaster(ctx)
-	} else {
-		ep, err = ss.GetProxy(ctx, singleEP)
+	var err error
+	var wantMaster = opts.DirectMaster || !cldata.Spec.UseProxy
+	if wantMaster {
+		ep = cs.masterCache.get(rg)
+	}
+	if ep == nil {
+		var ss *StolonStore
+		var release func()
+		ss, release, err = cs.getStolonStore(rg)
+		if err == nil {
+			if wantMaster {
+				ep, err = ss.GetMaster(ctx)
+				if err == nil && ep != nil {
+					cs.masterCache.put(rg, ep)
+				}
+			} else {
+				ep, err = ss.GetProxy(ctx, opts.SingleEP)
+			}
+			release()
+		}
+	}
+	if err != nil && opts.AllowStale {
+		ep, err = cs.getSavedMaster(ctx, rg, err)
 	}
 	if err != nil {
-		return nil, 0, err
+		return nil, nil, err
 	}
 	if ep == nil {
-		return nil, 0, MasterUnavailableError{}
+		return nil, nil, MasterUnavailableError{}
+	}
+
+	// master is resolved anyway to report its availability and priority
+	if opts.ServiceName != "" {
+		return map[string]string{"service": opts.ServiceName}, ep, nil
 	}
 
-	cp := map[string]string{
-		"user":   cldata.Spec.PgSuUsername,
-		"dbname": "postgres",
-		"host":   ep.Address,
-		"port":   ep.Port,
+	cp := suConnstrMap(cldata, rg, ep)
+	if err = ValidateConnOptions(cp); err != nil {
+		return nil, nil, err
 	}
+	return cp, ep, nil
+}
+
+// Get master of rg saved in masters key, marked as stale. rg is identified
+// among stored repgroups by its whole Stolon store identity; if there is no
+// such repgroup, several of them or no saved master, ssErr (error of Stolon
+// store access) is returned.
+func (cs *ClusterStore) getSavedMaster(ctx context.Context, rg *RepGroup, ssErr error) (*Endpoint, error) {
+	rgs, _, err := cs.GetRepGroups(ctx)
+	if err != nil {
+		return nil, ssErr
+	}
+	var rgid = -1
+	for id, r := range rgs {
+		if masterCacheKey(r) != masterCacheKey(rg) {
+			continue
+		}
+		if rgid != -1 {
+			return nil, ssErr // ambiguous
+		}
+		rgid = id
+	}
+	if rgid == -1 {
+		return nil, ssErr
+	}
+	masters, _, err := cs.GetMasters(ctx)
+	if _, ok := err.(*MastersCorruptError); err != nil && !ok {
+		return nil, ssErr
+	}
+	if m, ok := masters[rgid]; ok && m != nil {
+		return &Endpoint{Address: m.Address, Port: m.Port, Priority: m.Priority, Stale: true}, nil
+	}
+	return nil, ssErr
+}
+
+// Get all dbs of rg, see StolonStore.GetDBs
+func (cs *ClusterStore) GetRepGroupDBs(ctx context.Context, rg *RepGroup) (map[string]*Endpoint, error) {
+	ss, release, err := cs.getStolonStore(rg)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return ss.GetDBs(ctx)
+}
+
+// Get Stolon store of rg: if this rg has separate store, connect to it,
+// otherwise use our. Returned func must be called when store is not needed
+// anymore.
+func (cs *ClusterStore) getStolonStore(rg *RepGroup) (*StolonStore, func(), error) {
+	if rg.StoreConnInfo.Endpoints != "" {
+		ss, err := NewStolonStore(rg)
+		if err != nil {
+			return nil, nil, err
+		}
+		return ss, func() { ss.Close() }, nil
+	}
+	return NewStolonStoreFromExisting(rg, cs.Store), func() {}, nil
+}
+
+// Su connstr map for given node of rg, with ConnDefaults and rg's
+// ExtraConnOptions applied
+func SuConnstrMapForEndpoint(cldata *ClusterData, rg *RepGroup, ep *Endpoint) map[string]string {
+	return suConnstrMap(cldata, rg, ep)
+}
+
+// su connstr map for node of rg (might be nil), see ConnDefaults for
+// precedence
+func suConnstrMap(cldata *ClusterData, rg *RepGroup, ep *Endpoint) map[string]string {
+	var cp = cldata.Spec.ConnDefaults.options()
+	if rg != nil {
+		for opt, val := range rg.ExtraConnOptions {
+			cp[opt] = val
+		}
+	}
+	cp["user"] = cldata.Spec.PgSuUsername
+	cp["dbname"] = "postgres"
+	cp["host"] = ep.Address
+	cp["port"] = ep.Port
 	if cldata.Spec.PgSuAuthMethod != "trust" {
 		cp["password"] = cldata.Spec.PgSuPassword
+	} else {
+		delete(cp, "password")
 	}
-	return cp, ep.Priority, nil
+	return cp
+}
+
+func (cd *ConnDefaults) options() map[string]string {
+	var opts = make(map[string]string)
+	for opt, val := range cd.Options {
+		opts[opt] = val
+	}
+	if cd.ConnectTimeout != 0 {
+		opts["connect_timeout"] = strconv.Itoa(cd.ConnectTimeout)
+	}
+	if cd.SSLMode != "" {
+		opts["sslmode"] = cd.SSLMode
+	}
+	if cd.ApplicationName != "" {
+		opts["application_name"] = cd.ApplicationName
+	}
+	return opts
+}
+
+// libpq option -> environment variable, for all libpq keywords having one
+var connEnvVars = map[string]string{
+	"host":     "PGHOST",
+	"hostaddr": "PGHOSTADDR",
+	"port":     "PGPORT",
+	"user":     "PGUSER",
+	"password": "PGPASSWORD",
+	"passfile": "PGPASSFILE",
+	"dbname":   "PGDATABASE",
+	"service":  "PGSERVICE",
+	"options":  "PGOPTIONS",
+
+	"channel_binding":          "PGCHANNELBINDING",
+	"sslmode":                  "PGSSLMODE",
+	"requiressl":               "PGREQUIRESSL",
+	"sslcompression":           "PGSSLCOMPRESSION",
+	"sslcert":                  "PGSSLCERT",
+	"sslkey":                   "PGSSLKEY",
+	"sslcertmode":              "PGSSLCERTMODE",
+	"sslrootcert":              "PGSSLROOTCERT",
+	"sslcrl":                   "PGSSLCRL",
+	"sslcrldir":                "PGSSLCRLDIR",
+	"sslsni":                   "PGSSLSNI",
+	"ssl_min_protocol_version": "PGSSLMINPROTOCOLVERSION",
+	"ssl_max_protocol_version": "PGSSLMAXPROTOCOLVERSION",
+	"requirepeer":              "PGREQUIREPEER",
+	"require_auth":             "PGREQUIREAUTH",
+	"gssencmode":               "PGGSSENCMODE",
+	"krbsrvname":               "PGKRBSRVNAME",
+	"gsslib":                   "PGGSSLIB",
+	"gssdelegation":            "PGGSSDELEGATION",
+
+	"connect_timeout":      "PGCONNECT_TIMEOUT",
+	"client_encoding":      "PGCLIENTENCODING",
+	"application_name":     "PGAPPNAME",
+	"target_session_attrs": "PGTARGETSESSIONATTRS",
+	"load_balance_hosts":   "PGLOADBALANCEHOSTS",
+}
+
+// Get current su connection info for this rg as KEY=VALUE libpq env
+// variables, e.g. to exec psql or pg_dump. Entries are sorted. Fails if
+// connstr has options which can't be set via environment (e.g. keepalives),
+// as connection made without them might behave differently.
+func (cs *ClusterStore) GetSuConnEnv(ctx context.Context, rg *RepGroup, cldata *ClusterData) ([]string, error) {
+	cp, _, err := cs.GetSuConnstrMap(ctx, rg, cldata, false)
+	if err != nil {
+		return nil, err
+	}
+	return connEnv(cp)
+}
+
+func connEnv(cp map[string]string) ([]string, error) {
+	var env = make([]string, 0, len(cp))
+	var noenv = make([]string, 0)
+	for k, v := range cp {
+		if v == "" {
+			continue
+		}
+		envvar, ok := connEnvVars[k]
+		if !ok {
+			noenv = append(noenv, k)
+			continue
+		}
+		env = append(env, fmt.Sprintf("%s=%s", envvar, v))
+	}
+	if len(noenv) != 0 {
+		sort.Strings(noenv)
+		return nil, fmt.Errorf("libpq options can't be passed via environment: %s", strings.Join(noenv, ", "))
+	}
+	sort.Strings(env)
+	return env, nil
 }
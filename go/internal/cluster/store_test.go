@@ -0,0 +1,174 @@
+// Copyright (c) 2019, Postgres Professional
+
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	etcdclientv3 "go.etcd.io/etcd/clientv3"
+)
+
+// Tests needing the store run against etcd given by this variable, e.g.
+// SHARDMAN_TEST_STORE_ENDPOINTS=http://127.0.0.1:2379, and are skipped
+// otherwise. Each test works in its own cluster and Stolon prefix, removed
+// afterwards.
+const testStoreEndpointsEnv = "SHARDMAN_TEST_STORE_ENDPOINTS"
+
+const testStolonPrefix = "shardman-test-stolon"
+
+func newTestClusterStore(tb testing.TB) *ClusterStore {
+	endpoints := os.Getenv(testStoreEndpointsEnv)
+	if endpoints == "" {
+		tb.Skipf("%s is not set", testStoreEndpointsEnv)
+	}
+	name := fmt.Sprintf("test-%d", time.Now().UnixNano())
+	cs, err := NewClusterStore(&ClusterStoreConnInfo{
+		ClusterName:    name,
+		StoreConnInfo:  StoreConnInfo{Endpoints: endpoints},
+		RequestTimeout: 5,
+	})
+	if err != nil {
+		tb.Fatalf("failed to create cluster store: %v", err)
+	}
+	tb.Cleanup(func() {
+		ctx := context.Background()
+		cli := cs.Store.GetClient()
+		cli.Delete(ctx, cs.StorePath+"/", etcdclientv3.WithPrefix())
+		cli.Delete(ctx, filepath.Join(testStolonPrefix, name)+"/", etcdclientv3.WithPrefix())
+		cs.Close()
+	})
+	return cs
+}
+
+// Repgroup using Stolon in our store, under test prefix
+func testRepGroup(cs *ClusterStore) *RepGroup {
+	return &RepGroup{StolonName: cs.ClusterName, StorePrefix: testStolonPrefix}
+}
+
+// Make Stolon of rg report master at address:5432
+func putTestStolonMaster(tb testing.TB, cs *ClusterStore, rg *RepGroup, address string) {
+	var clusterData = StolonClusterData{
+		Keepers: Keepers{"keeper": &Keeper{}},
+		DBs: map[string]*DB{
+			"db": &DB{
+				Spec:   &DBSpec{KeeperUID: "keeper", Role: "master"},
+				Status: DBStatus{Healthy: true, ListenAddress: address, Port: "5432"},
+			},
+		},
+		Proxy: &Proxy{Spec: ProxySpec{MasterDBUID: "db"}},
+	}
+	clusterDataj, err := json.Marshal(&clusterData)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	path := filepath.Join(rg.StorePrefix, rg.StolonName, "clusterdata")
+	if err = cs.Store.Put(context.Background(), path, clusterDataj); err != nil {
+		tb.Fatalf("failed to put Stolon cluster data: %v", err)
+	}
+}
+
+func testClusterData() *ClusterData {
+	return &ClusterData{Spec: ClusterSpec{PgSuUsername: "postgres", PgSuAuthMethod: "trust"}}
+}
+
+func TestVerifyStolonSpecPatchRoundTrip(t *testing.T) {
+	var yes, no = true, false
+	var maxStandbys uint16 = 3
+	var maxLag uint32 = 1 << 30
+	var initMode = ClusterInitMode("new")
+	var tests = []struct {
+		name string
+		spec StolonSpec
+	}{
+		{"empty", StolonSpec{}},
+		{"scalars", StolonSpec{
+			SleepInterval:          &Duration{5 * time.Second},
+			MaxStandbys:            &maxStandbys,
+			MaxStandbyLag:          &maxLag,
+			SynchronousReplication: &yes,
+			UsePgrewind:            &no,
+			InitMode:               &initMode,
+		}},
+		{"nested structs", StolonSpec{
+			NewConfig: &NewConfig{Locale: "C", Encoding: "UTF8", DataChecksums: true},
+		}},
+		{"pgParameters", StolonSpec{
+			PGParameters: PGParameters{
+				"shared_preload_libraries": "pg_pathman, postgres_fdw",
+				"work_mem":                 "64MB",
+				"log_line_prefix":          "%m [%p] ",
+			},
+		}},
+		{"empty pgParameters", StolonSpec{PGParameters: PGParameters{}}},
+		{"slices", StolonSpec{
+			AdditionalMasterReplicationSlots: []string{"slot1", "slot2"},
+			PGHBA:                            []string{"host all all 0.0.0.0/0 md5", "local all all trust"},
+		}},
+		{"empty slices", StolonSpec{
+			AdditionalMasterReplicationSlots: []string{},
+			PGHBA:                            []string{},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := VerifyStolonSpecPatchRoundTrip(&tt.spec); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+// Comment is mistakenly excluded from json
+type badTagSpec struct {
+	Name    string `json:"name,omitempty"`
+	Comment string `json:"-"`
+}
+
+func TestVerifyPatchRoundTripBadTag(t *testing.T) {
+	var tests = []struct {
+		name    string
+		spec    badTagSpec
+		wantErr bool
+	}{
+		{"untouched fields", badTagSpec{Name: "rg"}, false},
+		{"dropped field", badTagSpec{Name: "rg", Comment: "lost"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyPatchRoundTrip(&tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestConnEnv(t *testing.T) {
+	for opt, _ := range connEnvVars {
+		if !libpqKeywords[opt] {
+			t.Errorf("%s has env var, but is not a libpq keyword", opt)
+		}
+	}
+
+	env, err := connEnv(map[string]string{"host": "10.0.0.1", "port": "5432", "sslmode": "verify-full",
+		"sslrootcert": "/etc/ca.pem", "target_session_attrs": "read-write", "password": ""})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []string{"PGHOST=10.0.0.1", "PGPORT=5432", "PGSSLMODE=verify-full",
+		"PGSSLROOTCERT=/etc/ca.pem", "PGTARGETSESSIONATTRS=read-write"}
+	if strings.Join(env, " ") != strings.Join(want, " ") {
+		t.Errorf("expected %v, got %v", want, env)
+	}
+
+	if env, err = connEnv(map[string]string{"host": "10.0.0.1", "keepalives": "1"}); err == nil {
+		t.Errorf("expected error for keepalives, got %v", env)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright (c) 2019, Postgres Professional
+
+// Builders of deterministic, valid cluster fixtures for tests. Production
+// code must not import this package.
+package testutil
+
+import (
+	"context"
+	"fmt"
+
+	"postgrespro.ru/shardman/internal/cluster"
+)
+
+type Fixture struct {
+	ClusterData *cluster.ClusterData
+	RepGroups   map[int]*cluster.RepGroup
+	Masters     map[int]*cluster.Master
+}
+
+type ClusterDataBuilder struct {
+	fixture Fixture
+}
+
+// Start with minimal valid cluster data: trust auth, fixed su/repl users and
+// the spec defaults init would set, no repgroups.
+func NewTestClusterData() *ClusterDataBuilder {
+	var initMode cluster.ClusterInitMode = "new"
+	var autopgrestart = true
+	spec := cluster.ClusterSpec{
+		PgSuAuthMethod:   "trust",
+		PgSuUsername:     "postgres",
+		PgReplAuthMethod: "trust",
+		PgReplUsername:   "repluser",
+		StolonSpec: cluster.StolonSpec{
+			InitMode:           &initMode,
+			AutomaticPgRestart: &autopgrestart,
+			PGHBA: []string{
+				"host all postgres 0.0.0.0/0 trust",
+				"host all postgres ::0/0 trust",
+			},
+			PGParameters: map[string]string{
+				"wal_level":                "logical",
+				"shared_preload_libraries": "shardman",
+			},
+		},
+	}
+	return &ClusterDataBuilder{fixture: Fixture{
+		ClusterData: &cluster.ClusterData{
+			FormatVersion: cluster.CurrentFormatVersion,
+			Spec:          spec,
+		},
+		RepGroups: make(map[int]*cluster.RepGroup),
+		Masters:   make(map[int]*cluster.Master),
+	}}
+}
+
+// Modify spec in place
+func (b *ClusterDataBuilder) WithSpec(modify func(spec *cluster.ClusterSpec)) *ClusterDataBuilder {
+	modify(&b.fixture.ClusterData.Spec)
+	return b
+}
+
+// Add repgroup with next rgid (max + 1, as addrepgroup does) using shardman
+// store. Its master is host rgN, port 5432, and SysId equals rgid.
+func (b *ClusterDataBuilder) WithRepGroup(stolonName string) *ClusterDataBuilder {
+	var rgid = 0
+	for id, _ := range b.fixture.RepGroups {
+		if id > rgid {
+			rgid = id
+		}
+	}
+	rgid++
+	return b.WithRepGroupID(rgid, &cluster.RepGroup{
+		StolonName:  stolonName,
+		StorePrefix: "stolon/cluster",
+		SysId:       int64(rgid),
+	}).WithMaster(rgid, fmt.Sprintf("rg%d", rgid), "5432")
+}
+
+// Add (or replace) repgroup with given rgid as is
+func (b *ClusterDataBuilder) WithRepGroupID(rgid int, rg *cluster.RepGroup) *ClusterDataBuilder {
+	b.fixture.RepGroups[rgid] = rg
+	return b
+}
+
+// Set saved master of repgroup
+func (b *ClusterDataBuilder) WithMaster(rgid int, address string, port string) *ClusterDataBuilder {
+	b.fixture.Masters[rgid] = &cluster.Master{Address: address, Port: port}
+	return b
+}
+
+func (b *ClusterDataBuilder) Build() *Fixture {
+	return &b.fixture
+}
+
+// Write the fixture to the store
+func (f *Fixture) Put(ctx context.Context, cs *cluster.ClusterStore) error {
+	if err := cs.PutClusterData(ctx, f.ClusterData); err != nil {
+		return err
+	}
+	if err := cs.PutRepGroups(ctx, f.RepGroups); err != nil {
+		return err
+	}
+	return cs.PutMasters(ctx, f.Masters)
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2019, Postgres Professional
+
+package testutil_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	etcdclientv3 "go.etcd.io/etcd/clientv3"
+
+	"postgrespro.ru/shardman/internal/cluster"
+	"postgrespro.ru/shardman/internal/cluster/testutil"
+)
+
+// same variable as store tests of package cluster use
+const testStoreEndpointsEnv = "SHARDMAN_TEST_STORE_ENDPOINTS"
+
+func newTestClusterStore(tb testing.TB) *cluster.ClusterStore {
+	endpoints := os.Getenv(testStoreEndpointsEnv)
+	if endpoints == "" {
+		tb.Skipf("%s is not set", testStoreEndpointsEnv)
+	}
+	cs, err := cluster.NewClusterStore(&cluster.ClusterStoreConnInfo{
+		ClusterName:    fmt.Sprintf("test-%d", time.Now().UnixNano()),
+		StoreConnInfo:  cluster.StoreConnInfo{Endpoints: endpoints},
+		RequestTimeout: 5,
+	})
+	if err != nil {
+		tb.Fatalf("failed to create cluster store: %v", err)
+	}
+	tb.Cleanup(func() {
+		cs.Store.GetClient().Delete(context.Background(), cs.StorePath+"/", etcdclientv3.WithPrefix())
+		cs.Close()
+	})
+	return cs
+}
+
+func TestWithRepGroup(t *testing.T) {
+	f := testutil.NewTestClusterData().WithRepGroup("cl1").WithRepGroup("cl2").Build()
+	if len(f.RepGroups) != 2 || f.RepGroups[1].StolonName != "cl1" || f.RepGroups[2].StolonName != "cl2" {
+		t.Fatalf("unexpected repgroups %v", f.RepGroups)
+	}
+	if m := f.Masters[2]; m == nil || m.Address != "rg2" || m.Port != "5432" {
+		t.Fatalf("unexpected master of repgroup 2: %v", m)
+	}
+}
+
+func TestFixturePut(t *testing.T) {
+	cs := newTestClusterStore(t)
+	ctx := context.Background()
+	f := testutil.NewTestClusterData().
+		WithSpec(func(spec *cluster.ClusterSpec) { spec.PgSuUsername = "su" }).
+		WithRepGroup("cl1").
+		WithRepGroup("cl2").
+		Build()
+	if err := f.Put(ctx, cs); err != nil {
+		t.Fatalf("failed to put fixture: %v", err)
+	}
+
+	cldata, _, err := cs.GetClusterData(ctx)
+	if err != nil {
+		t.Fatalf("failed to get cluster data: %v", err)
+	}
+	if cldata == nil || cldata.Spec.PgSuUsername != "su" {
+		t.Fatalf("unexpected cluster data %+v", cldata)
+	}
+	rgs, _, err := cs.GetRepGroups(ctx)
+	if err != nil {
+		t.Fatalf("failed to get repgroups: %v", err)
+	}
+	if !reflect.DeepEqual(rgs, f.RepGroups) {
+		t.Fatalf("repgroups: got %v, want %v", rgs, f.RepGroups)
+	}
+	masters, _, err := cs.GetMasters(ctx)
+	if err != nil {
+		t.Fatalf("failed to get masters: %v", err)
+	}
+	if !reflect.DeepEqual(masters, f.Masters) {
+		t.Fatalf("masters: got %v, want %v", masters, f.Masters)
+	}
+}
@@ -0,0 +1,231 @@
+// Copyright (c) 2019, Postgres Professional
+
+// watching store keys
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	etcdclientv3 "go.etcd.io/etcd/clientv3"
+
+	"postgrespro.ru/shardman/internal/store"
+)
+
+const (
+	watchMinBackoff = 500 * time.Millisecond
+	watchMaxBackoff = 30 * time.Second
+)
+
+// Watch the key and send each its new value to returned chan; nil is sent when
+// key is deleted. The chan is closed only when ctx is done.
+// etcd watch might be canceled (compaction, leader change, connection
+// failure); in this case it is re-established with exponential backoff,
+// resuming from the last seen revision. If that revision is already compacted,
+// current value is re-read and sent. Thus delivery is at least once: the same
+// value might be sent more than once, and intermediate values might be missed
+// after compaction, but the latest value is never lost.
+func watchKey(ctx context.Context, s *store.EtcdV3Store, key string) <-chan *store.KVPair {
+	out := make(chan *store.KVPair)
+	go func() {
+		defer close(out)
+		var rev int64 = 0 // last seen revision, 0 means current state must be read
+		var backoff = watchMinBackoff
+		send := func(pair *store.KVPair) bool {
+			select {
+			case out <- pair:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		for {
+			if rev == 0 {
+				pair, storeRev, err := s.GetWithRevision(ctx, key)
+				if err == nil {
+					if !send(pair) {
+						return
+					}
+					rev = storeRev
+				}
+			}
+			if rev != 0 {
+				wctx, wcancel := context.WithCancel(etcdclientv3.WithRequireLeader(ctx))
+				wch := s.GetClient().Watch(wctx, key, etcdclientv3.WithRev(rev+1))
+				for wresp := range wch {
+					if wresp.CompactRevision != 0 {
+						rev = 0 // missed some changes, reread
+						break
+					}
+					if wresp.Canceled || wresp.Err() != nil {
+						break
+					}
+					for _, ev := range wresp.Events {
+						var pair *store.KVPair = nil
+						if ev.Type == etcdclientv3.EventTypePut {
+							pair = &store.KVPair{Key: string(ev.Kv.Key), Value: ev.Kv.Value,
+								LastIndex: uint64(ev.Kv.ModRevision)}
+						}
+						if !send(pair) {
+							wcancel()
+							return
+						}
+						rev = ev.Kv.ModRevision
+					}
+					backoff = watchMinBackoff
+				}
+				wcancel()
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > watchMaxBackoff {
+				backoff = watchMaxBackoff
+			}
+		}
+	}()
+	return out
+}
+
+// Watch global cluster data. nil is sent if cluster data is removed;
+// undecodable (or undecryptable) values are skipped. Delivery is at least once, see watchKey.
+func (cs *ClusterStore) WatchClusterData(ctx context.Context) <-chan *ClusterData {
+	out := make(chan *ClusterData)
+	in := watchKey(ctx, &cs.Store, filepath.Join(cs.StorePath, "clusterdata"))
+	go func() {
+		defer close(out)
+		for pair := range in {
+			var cldata *ClusterData = nil
+			if pair != nil {
+				cldata = &ClusterData{}
+				if err := json.Unmarshal(pair.Value, cldata); err != nil {
+					continue
+				}
+				if err := cs.decryptClusterData(cldata); err != nil {
+					continue
+				}
+			}
+			select {
+			case out <- cldata:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// Watch repgroups. nil is sent if repgroups are removed; undecodable values
+// are skipped. Delivery is at least once, see watchKey.
+func (cs *ClusterStore) WatchRepGroups(ctx context.Context) <-chan map[int]*RepGroup {
+	out := make(chan map[int]*RepGroup)
+	in := watchKey(ctx, &cs.Store, filepath.Join(cs.StorePath, "repgroups"))
+	go func() {
+		defer close(out)
+		for pair := range in {
+			var rgs map[int]*RepGroup = nil
+			if pair != nil {
+				var err error
+				if rgs, err = unmarshalRepGroups(pair.Value); err != nil {
+					continue
+				}
+				rgs = cs.filterRepGroups(rgs)
+			}
+			select {
+			case out <- rgs:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// Watch saved masters. nil is sent if masters are removed; undecodable values
+// are skipped. Delivery is at least once, see watchKey.
+func (cs *ClusterStore) WatchMasters(ctx context.Context) <-chan map[int]*Master {
+	out := make(chan map[int]*Master)
+	in := watchKey(ctx, &cs.Store, filepath.Join(cs.StorePath, "masters"))
+	go func() {
+		defer close(out)
+		for pair := range in {
+			var masters map[int]*Master = nil
+			if pair != nil {
+				var err error
+				if masters, err = unmarshalMasters(pair.Value); err != nil {
+					continue
+				}
+				masters = cs.filterMasters(masters)
+			}
+			select {
+			case out <- masters:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// Watch master of one repgroup in its Stolon store and send it each time it
+// changes, starting with the current one. nil is sent when repgroup has no
+// master, e.g. during failover. Repgroup is looked up once, at call time.
+// Changes also invalidate master cache, see EnableMasterCache.
+func (cs *ClusterStore) WatchMaster(ctx context.Context, rgid int) (<-chan *Master, error) {
+	rgs, _, err := cs.GetRepGroups(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rg, ok := rgs[rgid]
+	if !ok {
+		return nil, fmt.Errorf("repgroup %d not found", rgid)
+	}
+	ss, release, err := cs.getStolonStore(rg)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan *Master)
+	in := watchKey(ctx, &ss.store, filepath.Join(ss.storePath, "clusterdata"))
+	go func() {
+		defer release()
+		defer close(out)
+		var last *Master = nil
+		var first = true
+		for pair := range in {
+			var master *Master = nil
+			if pair != nil {
+				var clusterData StolonClusterData
+				if err := json.Unmarshal(pair.Value, &clusterData); err != nil {
+					continue
+				}
+				if ep := clusterData.master(); ep != nil {
+					master = &Master{Address: ep.Address, Port: ep.Port, Priority: ep.Priority}
+				}
+			}
+			// Stolon rewrites clusterdata often, report only changes
+			if !first && (last == nil) == (master == nil) && (last == nil || *last == *master) {
+				continue
+			}
+			if !first {
+				cs.masterCache.invalidate(rg)
+			}
+			first = false
+			last = master
+			select {
+			case out <- master:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
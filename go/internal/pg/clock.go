@@ -0,0 +1,127 @@
+// Copyright (c) 2019, Postgres Professional
+
+package pg
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx"
+
+	"postgrespro.ru/shardman/internal/cluster"
+	tlswrap "postgrespro.ru/shardman/internal/tls"
+)
+
+// Clock skews against local time, positive if remote clock is ahead
+type ClockSkew struct {
+	Max     time.Duration // maximum absolute skew observed
+	Etcd    map[string]time.Duration
+	Masters map[int]time.Duration
+}
+
+// remote time is sampled between before and after; compare it to the midpoint
+func skew(remote time.Time, before time.Time, after time.Time) time.Duration {
+	return remote.Sub(before.Add(after.Sub(before) / 2))
+}
+
+func abs(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// etcd client accepts bare host:port endpoints too and talks TLS to them iff
+// TLS is configured, i.e. some other endpoint is https
+func etcdEndpointURL(endp string, secure bool) string {
+	endp = strings.TrimSuffix(endp, "/")
+	if strings.Contains(endp, "://") {
+		return endp
+	}
+	if secure {
+		return "https://" + endp
+	}
+	return "http://" + endp
+}
+
+// Compare local clock with clocks of etcd members and masters of all
+// repgroups. etcd API doesn't expose time, so we look at the Date header of
+// its http /version endpoint; it has one second resolution and thus etcd skews
+// are accurate only up to a second.
+func CheckClockSkew(ctx context.Context, cs *cluster.ClusterStore, hpc *cluster.StoreConnInfo) (*ClockSkew, error) {
+	var res = &ClockSkew{
+		Etcd:    make(map[string]time.Duration),
+		Masters: make(map[int]time.Duration),
+	}
+
+	endpoints := strings.Split(hpc.Endpoints, ",")
+	var client = &http.Client{Timeout: 5 * time.Second}
+	for _, endp := range endpoints {
+		if strings.HasPrefix(endp, "https") {
+			tlsConfig, err := tlswrap.NewTLSConfig(hpc.CertFile, hpc.Key, hpc.CAFile, false)
+			if err != nil {
+				return nil, fmt.Errorf("cannot create store tls config: %v", err)
+			}
+			client.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+			break
+		}
+	}
+	for _, endp := range endpoints {
+		req, err := http.NewRequest("GET", etcdEndpointURL(endp, client.Transport != nil)+"/version", nil)
+		if err != nil {
+			return nil, err
+		}
+		before := time.Now()
+		resp, err := client.Do(req.WithContext(ctx))
+		after := time.Now()
+		if err != nil {
+			return nil, fmt.Errorf("failed to query etcd endpoint %s: %v", endp, err)
+		}
+		resp.Body.Close()
+		remote, err := http.ParseTime(resp.Header.Get("Date"))
+		if err != nil {
+			return nil, fmt.Errorf("etcd endpoint %s returned no valid Date: %v", endp, err)
+		}
+		res.Etcd[endp] = skew(remote, before, after)
+		if abs(res.Etcd[endp]) > res.Max {
+			res.Max = abs(res.Etcd[endp])
+		}
+	}
+
+	cldata, _, err := cs.GetClusterData(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get cluster data: %v", err)
+	}
+	if cldata == nil {
+		return nil, fmt.Errorf("cluster data not found")
+	}
+	rgs, _, err := cs.GetRepGroups(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get repgroups: %v", err)
+	}
+	var mu sync.Mutex
+	_, err = ForEachRepGroupMaster(ctx, cs, rgs, cldata, func(rgid int, conn *pgx.Conn) error {
+		var remote time.Time
+		before := time.Now()
+		err := conn.QueryRow("select clock_timestamp()").Scan(&remote)
+		after := time.Now()
+		if err != nil {
+			return fmt.Errorf("failed to get time: %v", err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		res.Masters[rgid] = skew(remote, before, after)
+		if abs(res.Masters[rgid]) > res.Max {
+			res.Max = abs(res.Masters[rgid])
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
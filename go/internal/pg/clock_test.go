@@ -0,0 +1,25 @@
+// Copyright (c) 2019, Postgres Professional
+
+package pg
+
+import (
+	"testing"
+)
+
+func TestEtcdEndpointURL(t *testing.T) {
+	var tests = []struct {
+		endp   string
+		secure bool
+		want   string
+	}{
+		{"http://127.0.0.1:2379", false, "http://127.0.0.1:2379"},
+		{"https://etcd:2379/", true, "https://etcd:2379"},
+		{"127.0.0.1:2379", false, "http://127.0.0.1:2379"},
+		{"etcd:2379", true, "https://etcd:2379"},
+	}
+	for _, tt := range tests {
+		if got := etcdEndpointURL(tt.endp, tt.secure); got != tt.want {
+			t.Errorf("etcdEndpointURL(%q, %v) = %q, expected %q", tt.endp, tt.secure, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright (c) 2019, Postgres Professional
+
+package pg
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx"
+
+	"postgrespro.ru/shardman/internal/cluster"
+)
+
+// Connector opens su connections to the current master of one repgroup. All
+// connection options (auth, proxy usage, etc) are derived from cluster data,
+// so callers needn't care about them.
+type Connector struct {
+	cs   *cluster.ClusterStore
+	rgid int
+	// retry policy for each resolved connstr; no retries by default
+	Retry ConnectRetry
+}
+
+// How to retry failed connection attempts, e.g. to wait until just
+// promoted master starts accepting connections
+type ConnectRetry struct {
+	Attempts int           // total number of attempts; 0 means 1
+	Backoff  time.Duration // delay before first retry, doubled each time
+}
+
+func NewConnector(cs *cluster.ClusterStore, rgid int) *Connector {
+	return &Connector{cs: cs, rgid: rgid}
+}
+
+// learn current connstr of the repgroup
+func (c *Connector) resolve(ctx context.Context) (string, *cluster.RepGroup, error) {
+	cldata, _, err := c.cs.GetClusterData(ctx)
+	if err != nil {
+		return "", nil, fmt.Errorf("cannot get cluster data: %v", err)
+	}
+	if cldata == nil {
+		return "", nil, fmt.Errorf("cluster data not found")
+	}
+	rgs, _, err := c.cs.GetRepGroups(ctx)
+	if err != nil {
+		return "", nil, fmt.Errorf("Failed to get repgroups: %v", err)
+	}
+	rg, ok := rgs[c.rgid]
+	if !ok {
+		return "", nil, fmt.Errorf("repgroup %d not found", c.rgid)
+	}
+	connstr, err := GetSuConnstr(ctx, c.cs, rg, cldata)
+	return connstr, rg, err
+}
+
+// Connect to the current master. If connection fails, master is resolved once
+// more and, if it has moved, connection is retried.
+func (c *Connector) Connect(ctx context.Context) (*pgx.Conn, error) {
+	connstr, rg, err := c.resolve(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := connectWithRetry(ctx, connstr, c.Retry)
+	if err == nil {
+		return conn, nil
+	}
+
+	// master might be cached
+	c.cs.ForgetMaster(rg)
+	newconnstr, _, rerr := c.resolve(ctx)
+	if rerr != nil || newconnstr == connstr {
+		return nil, err
+	}
+	return connectWithRetry(ctx, newconnstr, c.Retry)
+}
+
+// Check that connstr is valid and server accepts connections and queries
+func VerifyConnstr(ctx context.Context, connstr string, retry ConnectRetry) error {
+	conn, err := connectWithRetry(ctx, connstr, retry)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var one int
+	if err = conn.QueryRowEx(ctx, "select 1", nil).Scan(&one); err != nil {
+		return fmt.Errorf("test query failed: %v", err)
+	}
+	return nil
+}
+
+func connectWithRetry(ctx context.Context, connstr string, retry ConnectRetry) (*pgx.Conn, error) {
+	var backoff = retry.Backoff
+	for attempt := 1; ; attempt++ {
+		conn, err := connect(connstr)
+		if err == nil || attempt >= retry.Attempts {
+			return conn, err
+		}
+		// parsing won't get better
+		if _, perr := pgx.ParseConnectionString(connstr); perr != nil {
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func connect(connstr string) (*pgx.Conn, error) {
+	connconfig, err := pgx.ParseConnectionString(connstr)
+	if err != nil {
+		return nil, fmt.Errorf("connstring parsing \"%s\" failed: %v", connstr, err)
+	}
+	conn, err := pgx.Connect(connconfig)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to database: %v", err)
+	}
+	return conn, nil
+}
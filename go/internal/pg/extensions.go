@@ -0,0 +1,86 @@
+// Copyright (c) 2019, Postgres Professional
+
+package pg
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/jackc/pgx"
+
+	"postgrespro.ru/shardman/internal/cluster"
+)
+
+// Extension on some repgroup differing from the rest of the cluster
+type ExtensionDiscrepancy struct {
+	Extension string
+	Version   string // "" if not installed
+	Expected  string // most common installed version; "" if none has it
+}
+
+// Check that given extensions are installed at the same versions on masters
+// of all given repgroups. Returns rgid -> discrepancies, empty if all is
+// consistent.
+func CheckExtensionConsistency(ctx context.Context, cs *cluster.ClusterStore, rgs map[int]*cluster.RepGroup, cldata *cluster.ClusterData, extensions []string) (map[int][]ExtensionDiscrepancy, error) {
+	var installed = make(map[int]map[string]string) // rgid -> ext -> version
+	var mu sync.Mutex
+	_, err := ForEachRepGroupMaster(ctx, cs, rgs, cldata, func(rgid int, conn *pgx.Conn) error {
+		var versions = make(map[string]string)
+		rows, err := conn.Query("select extname, extversion from pg_extension")
+		if err != nil {
+			return fmt.Errorf("failed to get extensions: %v", err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var name, version string
+			if err = rows.Scan(&name, &version); err != nil {
+				return err
+			}
+			versions[name] = version
+		}
+		if rows.Err() != nil {
+			return rows.Err()
+		}
+		mu.Lock()
+		installed[rgid] = versions
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var rgids = make([]int, 0, len(installed))
+	for rgid, _ := range installed {
+		rgids = append(rgids, rgid)
+	}
+	sort.Ints(rgids)
+	var res = make(map[int][]ExtensionDiscrepancy)
+	for _, ext := range extensions {
+		// on tie, version of lower rgid wins
+		var counts = make(map[string]int)
+		var expected string
+		for _, rgid := range rgids {
+			version, ok := installed[rgid][ext]
+			if !ok {
+				continue
+			}
+			counts[version]++
+			if expected == "" || counts[version] > counts[expected] {
+				expected = version
+			}
+		}
+		for _, rgid := range rgids {
+			if version := installed[rgid][ext]; version != expected {
+				res[rgid] = append(res[rgid], ExtensionDiscrepancy{
+					Extension: ext,
+					Version:   version,
+					Expected:  expected,
+				})
+			}
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,226 @@
+// Copyright (c) 2019, Postgres Professional
+
+package pg
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jackc/pgx"
+
+	"postgrespro.ru/shardman/internal/cluster"
+	"postgrespro.ru/shardman/internal/shmnlog"
+	"postgrespro.ru/shardman/internal/store"
+)
+
+// Make options of foreign servers hp_rg_N at conn (connected to repgroup
+// self) match given connstrs of other repgroups, in one xact. Servers are
+// altered, not recreated, to keep foreign tables and user mappings. Returns
+// rgids of altered servers.
+func SyncForeignServers(conn *pgx.Conn, self int, connstrmaps map[int]map[string]string) ([]int, error) {
+	var altered []int
+	tx, err := conn.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin xact: %v", err)
+	}
+	defer tx.Rollback()
+
+	var rgids = make([]int, 0, len(connstrmaps))
+	for rgid, _ := range connstrmaps {
+		rgids = append(rgids, rgid)
+	}
+	sort.Ints(rgids)
+	for _, rgid := range rgids {
+		if rgid == self {
+			continue
+		}
+		var fsExists bool
+		err = tx.QueryRow(fmt.Sprintf(
+			"select exists (select 1 from pg_foreign_server where srvname = 'hp_rg_%d')",
+			rgid)).Scan(&fsExists)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check fs existence: %v", err)
+		}
+		if !fsExists {
+			/* should never happen */
+			return nil, fmt.Errorf("foreign server for rgid %d doesn't exist", rgid)
+		}
+		rows, err := tx.Query(fmt.Sprintf(
+			"select split_part(opt, '=', 1) k, split_part(opt, '=', 2) v from (select unnest(srvoptions) opt from pg_foreign_server where srvname = 'hp_rg_%d') o;",
+			rgid))
+		if err != nil {
+			return nil, fmt.Errorf("failed to retrieve fserver info: %v", err)
+		}
+		var currfsoptsmap = make(map[string]string)
+		var key, value string
+		for rows.Next() {
+			if err = rows.Scan(&key, &value); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			currfsoptsmap[key] = value
+		}
+		if rows.Err() != nil {
+			return nil, rows.Err()
+		}
+		newfsopts, _ := FormForeignServerOpts(connstrmaps[rgid])
+		currfsopts, err := FormForeignServerOpts(currfsoptsmap)
+		if err == nil && currfsopts == newfsopts {
+			continue
+		}
+		/* drop all currents opts */
+		for optname, _ := range currfsoptsmap {
+			_, err = tx.Exec(fmt.Sprintf(
+				"alter server hp_rg_%d options (drop %s)",
+				rgid, optname))
+			if err != nil {
+				return nil, fmt.Errorf("failed to drop fs opts: %v", err)
+			}
+		}
+		/* add all new opts */
+		_, err = tx.Exec(fmt.Sprintf("alter server hp_rg_%d %s", rgid, newfsopts))
+		if err != nil {
+			return nil, fmt.Errorf("failed to set new fs opts: %v", err)
+		}
+		altered = append(altered, rgid)
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit xact: %v", err)
+	}
+	return altered, nil
+}
+
+const defaultFdwReconcileInterval = 5 * time.Second
+
+// Keeps foreign servers of all repgroups pointing to current masters of other
+// repgroups. Reconciliation happens on each change of repgroups or saved
+// masters and every Interval, as failover is not necessarily reflected in
+// shardman store.
+type FdwReconciler struct {
+	cs       *cluster.ClusterStore
+	hl       *shmnlog.Logger
+	Interval time.Duration
+	// persistent connections, rgid -> conn and its connstr
+	conns    map[int]*pgx.Conn
+	connstrs map[int]string
+}
+
+func NewFdwReconciler(cs *cluster.ClusterStore, hl *shmnlog.Logger) *FdwReconciler {
+	return &FdwReconciler{
+		cs:       cs,
+		hl:       hl,
+		Interval: defaultFdwReconcileInterval,
+		conns:    make(map[int]*pgx.Conn),
+		connstrs: make(map[int]string),
+	}
+}
+
+// Run until ctx is done. Errors are logged and retried at next round.
+func (r *FdwReconciler) Run(ctx context.Context) {
+	ctx = store.WithMetricsLabel(ctx, "reconcile")
+	rgsch := r.cs.WatchRepGroups(ctx)
+	mastersch := r.cs.WatchMasters(ctx)
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	defer r.closeConns()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-rgsch:
+		case <-mastersch:
+		case <-ticker.C:
+		}
+		r.reconcile(ctx)
+	}
+}
+
+func (r *FdwReconciler) closeConn(rgid int) {
+	r.conns[rgid].Close()
+	delete(r.conns, rgid)
+	delete(r.connstrs, rgid)
+}
+
+func (r *FdwReconciler) closeConns() {
+	for rgid, _ := range r.conns {
+		r.closeConn(rgid)
+	}
+}
+
+func (r *FdwReconciler) keepConnstr(connstrs map[int]string, rgid int) {
+	if connstr, ok := r.connstrs[rgid]; ok {
+		connstrs[rgid] = connstr
+	}
+}
+
+func (r *FdwReconciler) reconcile(ctx context.Context) {
+	cldata, _, err := r.cs.GetClusterData(ctx)
+	if err != nil {
+		r.hl.Errorf("cannot get cluster data: %v", err)
+		return
+	}
+	if cldata == nil {
+		return
+	}
+	allrgs, _, err := r.cs.GetRepGroups(ctx)
+	if err != nil {
+		r.hl.Errorf("Failed to get repgroups: %v", err)
+		return
+	}
+	// foreign servers to and at pending repgroups are created by addrepgroup
+	rgs := cluster.ReadyRepGroups(allrgs)
+
+	// repgroup whose connstr can't be learned (e.g. it is in the middle of
+	// failover) is skipped: foreign servers pointing to it are left as they
+	// are, and so is our connection to it, if any
+	var connstrmaps = make(map[int]map[string]string)
+	var connstrs = make(map[int]string)
+	for rgid, rg := range rgs {
+		connstrmap, _, err := r.cs.GetSuConnstrMap(ctx, rg, cldata, false)
+		if err != nil {
+			r.hl.Errorf("Failed to get connstr for rgid %d: %v", rgid, err)
+			r.keepConnstr(connstrs, rgid)
+			continue
+		}
+		// pgx can't into multiple hosts, so fetch connstr with single
+		// endpoint as well
+		connstr, err := GetSuConnstr(ctx, r.cs, rg, cldata)
+		if err != nil {
+			r.hl.Errorf("Failed to get single EP connstr for rgid %d: %v", rgid, err)
+			r.keepConnstr(connstrs, rgid)
+			continue
+		}
+		connstrmaps[rgid] = connstrmap
+		connstrs[rgid] = connstr
+	}
+
+	for rgid, _ := range r.conns {
+		if connstrs[rgid] != r.connstrs[rgid] {
+			r.closeConn(rgid)
+		}
+	}
+	for rgid, connstr := range connstrs {
+		conn, ok := r.conns[rgid]
+		if !ok {
+			conn, err = connect(connstr)
+			if err != nil {
+				r.hl.Warnf("rgid %d: %v", rgid, err)
+				continue
+			}
+			r.conns[rgid] = conn
+			r.connstrs[rgid] = connstr
+		}
+		altered, err := SyncForeignServers(conn, rgid, connstrmaps)
+		if err != nil {
+			r.hl.Warnf("failed to sync foreign servers at rgid %d: %v", rgid, err)
+			r.closeConn(rgid)
+			continue
+		}
+		for _, fsrgid := range altered {
+			r.hl.Infof("altered foreign server to rg %d at rgid %d", fsrgid, rgid)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2019, Postgres Professional
+
+package pg
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/jackc/pgx"
+
+	"postgrespro.ru/shardman/internal/cluster"
+)
+
+// Connect to master of each given repgroup concurrently and run fn there;
+// connections are closed afterwards. fn is called from several goroutines at
+// once, so it must synchronize access to shared data itself. Returns rgid ->
+// error for repgroups where connection or fn failed, and error describing
+// the first of them (by rgid) if any.
+// Broadcaster keeps its connections across statements of one distributed
+// xact, and DetectSplitBrain connects to every node of a repgroup, not just
+// its master, so they keep their own loops.
+func ForEachRepGroupMaster(ctx context.Context, cs *cluster.ClusterStore, rgs map[int]*cluster.RepGroup, cldata *cluster.ClusterData, fn func(rgid int, conn *pgx.Conn) error) (map[int]error, error) {
+	var errs = make(map[int]error)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for rgid, rg := range rgs {
+		wg.Add(1)
+		go func(rgid int, rg *cluster.RepGroup) {
+			defer wg.Done()
+			err := withRepGroupMaster(ctx, cs, rgid, rg, cldata, fn)
+			if err != nil {
+				mu.Lock()
+				errs[rgid] = err
+				mu.Unlock()
+			}
+		}(rgid, rg)
+	}
+	wg.Wait()
+
+	if len(errs) == 0 {
+		return errs, nil
+	}
+	var failed = make([]int, 0, len(errs))
+	for rgid, _ := range errs {
+		failed = append(failed, rgid)
+	}
+	sort.Ints(failed)
+	return errs, fmt.Errorf("rgid %d: %v", failed[0], errs[failed[0]])
+}
+
+func withRepGroupMaster(ctx context.Context, cs *cluster.ClusterStore, rgid int, rg *cluster.RepGroup, cldata *cluster.ClusterData, fn func(rgid int, conn *pgx.Conn) error) error {
+	connstr, err := GetSuConnstr(ctx, cs, rg, cldata)
+	if err != nil {
+		return fmt.Errorf("failed to get connstr: %v", err)
+	}
+	conn, err := connect(connstr)
+	if err != nil {
+		cs.ForgetMaster(rg)
+		return err
+	}
+	defer conn.Close()
+	return fn(rgid, conn)
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2019, Postgres Professional
+
+package pg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx"
+
+	"postgrespro.ru/shardman/internal/cluster"
+)
+
+// Returned when partition is not on repgroup it was expected to be
+var ErrPartitionMoved = errors.New("partition was moved concurrently")
+
+// Reassign partition pnum of sharded table (unquoted relname) to repgroup
+// toRgid in metadata of all repgroups. Only metadata is switched: partition
+// data must have already been copied to toRgid (see commands.Rebalance),
+// otherwise nothing is changed and error is returned.
+func MovePartition(ctx context.Context, cs *cluster.ClusterStore, table string, pnum int, toRgid int) error {
+	cldata, _, err := cs.GetClusterData(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot get cluster data: %v", err)
+	}
+	if cldata == nil {
+		return fmt.Errorf("cluster data not found")
+	}
+	rgs, _, err := cs.GetRepGroups(ctx)
+	if err != nil {
+		return fmt.Errorf("Failed to get repgroups: %v", err)
+	}
+	rg, ok := rgs[toRgid]
+	if !ok {
+		return fmt.Errorf("repgroup %d doesn't exist", toRgid)
+	}
+	if rg.Pending {
+		return fmt.Errorf("repgroup %d is pending", toRgid)
+	}
+	return withRepGroupMaster(ctx, cs, toRgid, rg, cldata, func(rgid int, conn *pgx.Conn) error {
+		var fromRgid int
+		err := conn.QueryRow(fmt.Sprintf("select rgid from shardman.parts where rel = %s::regclass and pnum = %d",
+			QL(QI(table)), pnum)).Scan(&fromRgid)
+		if err == pgx.ErrNoRows {
+			return fmt.Errorf("partition %d of table %s not found", pnum, table)
+		} else if err != nil {
+			return err
+		}
+		if fromRgid == toRgid {
+			return nil
+		}
+		return CommitPartitionMove(conn, table, pnum, fromRgid, toRgid)
+	})
+}
+
+// Switch metadata of partition pnum of table from fromRgid to toRgid via conn
+// to toRgid's master, provided that it is still on fromRgid; otherwise
+// ErrPartitionMoved is returned. Moves committed through the same repgroup
+// are serialized.
+func CommitPartitionMove(conn *pgx.Conn, table string, pnum int, fromRgid int, toRgid int) error {
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	relid := fmt.Sprintf("%s::regclass", QL(QI(table)))
+	if _, err = tx.Exec(fmt.Sprintf("select pg_advisory_xact_lock(%s::oid::int, %d)", relid, pnum)); err != nil {
+		return fmt.Errorf("failed to lock partition: %v", err)
+	}
+	var rgid int
+	err = tx.QueryRow(fmt.Sprintf("select rgid from shardman.parts where rel = %s and pnum = %d", relid, pnum)).Scan(&rgid)
+	if err != nil {
+		return fmt.Errorf("failed to get partition location: %v", err)
+	}
+	if rgid != fromRgid {
+		return ErrPartitionMoved
+	}
+	_, err = tx.Exec(fmt.Sprintf("select shardman.part_moved(%s, %d, %d, %d)", relid, pnum, fromRgid, toRgid))
+	if err != nil {
+		return fmt.Errorf("failed to commit partmove: %v", err)
+	}
+	return tx.Commit()
+}
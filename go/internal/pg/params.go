@@ -0,0 +1,91 @@
+// Copyright (c) 2019, Postgres Professional
+
+package pg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx"
+
+	"postgrespro.ru/shardman/internal/cluster"
+)
+
+// how often to recheck parameters while waiting for keepers to apply them
+const pgParametersCheckInterval = 1 * time.Second
+
+// Set pgParameters cluster-wide by patching Stolon spec (see
+// UpdateStolonSpec) and verify they took effect: masters are polled with SHOW
+// until all values match or verifyTimeout expires. Values must be given as
+// SHOW prints them (e.g. '128MB', not '16384'), and parameters requiring
+// restart won't match until restart. Returns rgid -> param -> effective value
+// for mismatching ones. Masters unreachable till the deadline are reported as
+// error.
+func SetPgParameters(ctx context.Context, cs *cluster.ClusterStore, hpc *cluster.StoreConnInfo, params map[string]string, verifyTimeout time.Duration) (map[int]map[string]string, error) {
+	patch, err := json.Marshal(map[string]interface{}{"pgParameters": params})
+	if err != nil {
+		return nil, err
+	}
+	if err = cs.UpdateStolonSpec(ctx, hpc, patch, true, 0, cluster.PreflightMaster); err != nil {
+		return nil, fmt.Errorf("failed to update Stolon spec: %v", err)
+	}
+
+	deadline := time.Now().Add(verifyTimeout)
+	for {
+		mismatches, connerr, err := checkPgParameters(ctx, cs, params)
+		if err != nil {
+			return nil, err
+		}
+		if connerr == nil && len(mismatches) == 0 {
+			return mismatches, nil
+		}
+		if time.Now().After(deadline) || ctx.Err() != nil {
+			if connerr != nil {
+				return nil, connerr
+			}
+			return mismatches, nil
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(pgParametersCheckInterval):
+		}
+	}
+}
+
+// returns mismatches, error of some master (we might catch it during failover)
+// and other errors
+func checkPgParameters(ctx context.Context, cs *cluster.ClusterStore, params map[string]string) (map[int]map[string]string, error, error) {
+	cldata, _, err := cs.GetClusterData(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot get cluster data: %v", err)
+	}
+	rgs, _, err := cs.GetRepGroups(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to get repgroups: %v", err)
+	}
+
+	var mismatches = make(map[int]map[string]string)
+	var mu sync.Mutex
+	_, connerr := ForEachRepGroupMaster(ctx, cs, rgs, cldata, func(rgid int, conn *pgx.Conn) error {
+		for name, value := range params {
+			var current string
+			err := conn.QueryRow(fmt.Sprintf("show %s", QI(name))).Scan(&current)
+			if err != nil {
+				return fmt.Errorf("failed to show %s: %v", name, err)
+			}
+			if current != value {
+				mu.Lock()
+				if mismatches[rgid] == nil {
+					mismatches[rgid] = make(map[string]string)
+				}
+				mismatches[rgid][name] = current
+				mu.Unlock()
+			}
+		}
+		return nil
+	})
+	return mismatches, connerr, nil
+}
@@ -0,0 +1,47 @@
+// Copyright (c) 2019, Postgres Professional
+
+package pg
+
+import (
+	"context"
+	"fmt"
+
+	"postgrespro.ru/shardman/internal/cluster"
+)
+
+// Count partitions of sharded tables hosted by each repgroup. Every repgroup
+// is present in the result, those hosting nothing with 0.
+func PartitionCountsByRepGroup(ctx context.Context, cs *cluster.ClusterStore) (map[int]int, error) {
+	rgs, _, err := cs.GetRepGroups(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get repgroups: %v", err)
+	}
+	tables, err := GetTables(cs, ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sharded tables: %v", err)
+	}
+	var counts = make(map[int]int)
+	for rgid, _ := range rgs {
+		counts[rgid] = 0
+	}
+	for _, t := range tables {
+		for _, rgid := range t.Partmap {
+			counts[rgid]++
+		}
+	}
+	return counts, nil
+}
+
+// Plan rebalance of current partitions placement according to repgroups
+// weights, see cluster.PlanRebalance. Nothing is moved.
+func GenerateRebalancePlan(ctx context.Context, cs *cluster.ClusterStore) ([]cluster.PartitionMove, error) {
+	rgs, _, err := cs.GetRepGroups(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get repgroups: %v", err)
+	}
+	tables, err := GetTables(cs, ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sharded tables: %v", err)
+	}
+	return cluster.PlanRebalance(tables, rgs), nil
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"sort"
 	"strings"
+	"unicode"
 
 	"github.com/jackc/pgx"
 
@@ -292,7 +293,7 @@ func GetSuConnstrs(ctx context.Context, cs *cluster.ClusterStore) (map[int]strin
 	}
 
 	var connstrs = make(map[int]string)
-	for rgid, rg := range rgs {
+	for rgid, rg := range cluster.ReadyRepGroups(rgs) {
 		connstr, err := GetSuConnstr(ctx, cs, rg, cldata)
 		if err != nil {
 			return nil, err
@@ -302,7 +303,30 @@ func GetSuConnstrs(ctx context.Context, cs *cluster.ClusterStore) (map[int]strin
 	return connstrs, nil
 }
 
-// Get connstring + priority of current master
+// libpq options pgx v3 understands. It sends all other options to server as
+// startup parameters, i.e. GUCs, so server would reject connection with e.g.
+// keepalives or target_session_attrs. application_name, client_encoding and
+// options are ok as server handles them itself.
+var pgxConnOptions = map[string]bool{
+	"host": true, "port": true, "user": true, "password": true, "dbname": true,
+	"sslmode": true, "sslrootcert": true, "sslcert": true, "sslkey": true,
+	"connect_timeout": true, "application_name": true, "client_encoding": true,
+	"options": true,
+}
+
+// Drop options pgx can't use from su connstr map (ConnDefaults and repgroup's
+// ExtraConnOptions are meant for libpq clients, e.g. postgres_fdw and psql)
+func PgxConnstrMap(cp map[string]string) map[string]string {
+	var res = make(map[string]string, len(cp))
+	for opt, val := range cp {
+		if pgxConnOptions[opt] {
+			res[opt] = val
+		}
+	}
+	return res
+}
+
+// Get connstring + priority of current master, suitable for pgx
 func GetSuConnstrWithPriority(ctx context.Context, cs *cluster.ClusterStore, rg *cluster.RepGroup, cldata *cluster.ClusterData) (string, int, error) {
 	// always fetch single endpoint, because the only callers are Go code,
 	// and pgx doesn't support multiple hosts.
@@ -310,7 +334,7 @@ func GetSuConnstrWithPriority(ctx context.Context, cs *cluster.ClusterStore, rg
 	if err != nil {
 		return "", 0, err
 	}
-	return ConnString(cp), priority, nil
+	return ConnString(PgxConnstrMap(cp)), priority, nil
 }
 
 // just su connstring
@@ -322,7 +346,9 @@ func GetSuConnstr(ctx context.Context, cs *cluster.ClusterStore, rg *cluster.Rep
 }
 
 // ConnString returns a connection string, its entries are sorted so the
-// returned string can be reproducible and comparable
+// returned string can be reproducible and comparable. Values are quoted only
+// if they contain whitespace: pgx doesn't understand quotes at all.
+// ParseConnstr is the inverse.
 func ConnString(p map[string]string) string {
 	var kvs []string
 	escaper := strings.NewReplacer(`'`, `\'`, `\`, `\\`)
@@ -331,6 +357,8 @@ func ConnString(p map[string]string) string {
 			var val string = fmt.Sprintf("%s", escaper.Replace(v))
 			if k == "port" {
 				val = v /* pgx complains on port='5432' */
+			} else if strings.IndexFunc(v, unicode.IsSpace) != -1 {
+				val = "'" + val + "'"
 			}
 			kvs = append(kvs, fmt.Sprintf("%s=%s", k, val))
 		}
@@ -339,6 +367,82 @@ func ConnString(p map[string]string) string {
 	return strings.Join(kvs, " ")
 }
 
+// Parse libpq keyword/value connstr into map of options, handling quoting
+// and escaping as libpq does. URIs are not supported.
+func ParseConnstr(connstr string) (map[string]string, error) {
+	var p = make(map[string]string)
+	var s = []rune(connstr)
+	var i = 0
+	skipSpaces := func() {
+		for i < len(s) && unicode.IsSpace(s[i]) {
+			i++
+		}
+	}
+	for {
+		skipSpaces()
+		if i == len(s) {
+			return p, nil
+		}
+		// keyword
+		start := i
+		for i < len(s) && s[i] != '=' && !unicode.IsSpace(s[i]) {
+			i++
+		}
+		key := string(s[start:i])
+		if key == "" {
+			return nil, fmt.Errorf("missing keyword before \"=\" in connection string")
+		}
+		skipSpaces()
+		if i == len(s) || s[i] != '=' {
+			return nil, fmt.Errorf("missing \"=\" after \"%s\" in connection string", key)
+		}
+		i++
+		skipSpaces()
+
+		// value
+		var val []rune
+		if i < len(s) && s[i] == '\'' {
+			i++
+			for {
+				if i == len(s) {
+					return nil, fmt.Errorf("unterminated quoted string in connection string")
+				}
+				if s[i] == '\'' {
+					i++
+					break
+				}
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				val = append(val, s[i])
+				i++
+			}
+		} else {
+			for i < len(s) && !unicode.IsSpace(s[i]) {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				val = append(val, s[i])
+				i++
+			}
+		}
+		p[key] = string(val)
+	}
+}
+
+// Form pg_service.conf entry defining given connection options. Values are
+// taken literally till the end of line there, so no quoting is needed.
+func FormPgServiceEntry(name string, p map[string]string) string {
+	var kvs []string
+	for k, v := range p {
+		if v != "" {
+			kvs = append(kvs, fmt.Sprintf("%s=%s", k, v))
+		}
+	}
+	sort.Strings(kvs)
+	return fmt.Sprintf("[%s]\n%s\n", name, strings.Join(kvs, "\n"))
+}
+
 // postgres_fdw accepts user/password params in user mapping opts and
 // everything else in foreign server ones...
 func FormUserMappingOpts(p map[string]string) (string, error) {
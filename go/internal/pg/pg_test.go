@@ -0,0 +1,110 @@
+// Copyright (c) 2019, Postgres Professional
+
+package pg
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jackc/pgx"
+)
+
+func TestConnstrRoundTrip(t *testing.T) {
+	var tests = []struct {
+		name string
+		p    map[string]string
+	}{
+		{"plain", map[string]string{"host": "localhost", "port": "5432", "user": "postgres", "dbname": "postgres"}},
+		{"spaces", map[string]string{"password": "my secret pass", "options": "-c search_path=public"}},
+		{"quote", map[string]string{"password": `it's`, "application_name": `it's mine`}},
+		{"backslash", map[string]string{"password": `a\b`, "sslkey": `C:\keys\client key`}},
+		{"quote and backslash", map[string]string{"password": `\'`}},
+		{"tab", map[string]string{"password": "a\tb"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			connstr := ConnString(tt.p)
+			p, err := ParseConnstr(connstr)
+			if err != nil {
+				t.Fatalf("failed to parse %q: %v", connstr, err)
+			}
+			if !reflect.DeepEqual(p, tt.p) {
+				t.Errorf("%q parsed as %v, expected %v", connstr, p, tt.p)
+			}
+		})
+	}
+}
+
+// ConnString omits options with empty values
+func TestConnStringEmptyValues(t *testing.T) {
+	connstr := ConnString(map[string]string{"host": "localhost", "password": ""})
+	if connstr != "host=localhost" {
+		t.Errorf("expected \"host=localhost\", got %q", connstr)
+	}
+}
+
+func TestParseConnstr(t *testing.T) {
+	var tests = []struct {
+		connstr string
+		want    map[string]string
+	}{
+		{"", map[string]string{}},
+		{"  host=localhost   port=5432  ", map[string]string{"host": "localhost", "port": "5432"}},
+		{"host = localhost", map[string]string{"host": "localhost"}},
+		{"password='' host=localhost", map[string]string{"password": "", "host": "localhost"}},
+		{"password= host=localhost", map[string]string{"password": "host=localhost"}},
+		{"password=", map[string]string{"password": ""}},
+		{`password='a b\'c\\d'`, map[string]string{"password": `a b'c\d`}},
+		{`password=a\ b`, map[string]string{"password": "a b"}},
+	}
+	for _, tt := range tests {
+		p, err := ParseConnstr(tt.connstr)
+		if err != nil {
+			t.Errorf("failed to parse %q: %v", tt.connstr, err)
+			continue
+		}
+		if !reflect.DeepEqual(p, tt.want) {
+			t.Errorf("%q parsed as %v, expected %v", tt.connstr, p, tt.want)
+		}
+	}
+}
+
+func TestParseConnstrMalformed(t *testing.T) {
+	var tests = []string{
+		"password='unterminated",
+		`password='escaped quote\'`,
+		"host",
+		"host localhost",
+		"host=localhost port",
+		"=localhost",
+	}
+	for _, connstr := range tests {
+		if p, err := ParseConnstr(connstr); err == nil {
+			t.Errorf("expected error parsing %q, got %v", connstr, p)
+		}
+	}
+}
+
+func TestPgxConnstrMap(t *testing.T) {
+	cp := map[string]string{"host": "10.0.0.1", "port": "5432", "user": "postgres", "dbname": "postgres",
+		"sslmode": "verify-full", "sslrootcert": "/etc/ca.pem", "application_name": "shardman",
+		"keepalives_idle": "30", "target_session_attrs": "read-write", "channel_binding": "require",
+		"service": "rg1"}
+	want := map[string]string{"host": "10.0.0.1", "port": "5432", "user": "postgres", "dbname": "postgres",
+		"sslmode": "verify-full", "sslrootcert": "/etc/ca.pem", "application_name": "shardman"}
+	if got := PgxConnstrMap(cp); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	// whatever pgx doesn't consume goes to server as GUC
+	cp["sslmode"] = "disable"
+	delete(cp, "sslrootcert")
+	connstr := ConnString(PgxConnstrMap(cp))
+	config, err := pgx.ParseConnectionString(connstr)
+	if err != nil {
+		t.Fatalf("pgx failed to parse %q: %v", connstr, err)
+	}
+	if !reflect.DeepEqual(config.RuntimeParams, map[string]string{"application_name": "shardman"}) {
+		t.Errorf("unexpected startup parameters %v", config.RuntimeParams)
+	}
+}
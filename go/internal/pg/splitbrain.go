@@ -0,0 +1,46 @@
+// Copyright (c) 2019, Postgres Professional
+
+package pg
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"postgrespro.ru/shardman/internal/cluster"
+)
+
+// Find repgroups where more than one node is not in recovery, i.e. considers
+// itself master. Returns rgid -> addresses (host:port) of such nodes, only for
+// offending repgroups. Nodes which can't be reached are skipped: they can't
+// serve clients anyway.
+func DetectSplitBrain(ctx context.Context, cs *cluster.ClusterStore, rgs map[int]*cluster.RepGroup, cldata *cluster.ClusterData) (map[int][]string, error) {
+	var res = make(map[int][]string)
+	for rgid, rg := range rgs {
+		dbs, err := cs.GetRepGroupDBs(ctx, rg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get dbs of rgid %d: %v", rgid, err)
+		}
+		var masters []string
+		for _, ep := range dbs {
+			conn, err := connect(ConnString(PgxConnstrMap(cluster.SuConnstrMapForEndpoint(cldata, rg, ep))))
+			if err != nil {
+				continue
+			}
+			var inRecovery bool
+			err = conn.QueryRow("select pg_is_in_recovery()").Scan(&inRecovery)
+			conn.Close()
+			if err != nil {
+				continue
+			}
+			if !inRecovery {
+				masters = append(masters, fmt.Sprintf("%s:%s", ep.Address, ep.Port))
+			}
+		}
+		if len(masters) > 1 {
+			sort.Strings(masters)
+			res[rgid] = masters
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2019, Postgres Professional
+
+package pg
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/jackc/pgx"
+
+	"postgrespro.ru/shardman/internal/cluster"
+	"postgrespro.ru/shardman/internal/store"
+)
+
+// how many times to retry saving versions if they are concurrently modified
+const persistVersionsMaxAttempts = 5
+
+// Learn PG version (server_version_num, e.g. 110002) of each given repgroup's
+// master. Versions of repgroups which were reached are returned even if others
+// failed; like ForEachRepGroupMaster, rgid -> error for the failed ones and
+// error describing the first of them are returned along with them. If persist
+// is true, learned versions are also saved in the store (merged with versions
+// of other repgroups already there), so that callers not willing to connect
+// can use cs.GetRepGroupVersions; failure to save them is returned as error.
+func DiscoverRepGroupVersions(ctx context.Context, cs *cluster.ClusterStore, rgs map[int]*cluster.RepGroup, cldata *cluster.ClusterData, persist bool) (map[int]int, map[int]error, error) {
+	var versions = make(map[int]int)
+	var mu sync.Mutex
+	errs, connErr := ForEachRepGroupMaster(ctx, cs, rgs, cldata, func(rgid int, conn *pgx.Conn) error {
+		var version int
+		err := conn.QueryRow("select current_setting('server_version_num')::int").Scan(&version)
+		if err != nil {
+			return fmt.Errorf("failed to get server version: %v", err)
+		}
+		mu.Lock()
+		versions[rgid] = version
+		mu.Unlock()
+		return nil
+	})
+
+	if persist && len(versions) != 0 {
+		if err := persistRepGroupVersions(ctx, cs, versions); err != nil {
+			return versions, errs, fmt.Errorf("failed to save versions: %v", err)
+		}
+	}
+	return versions, errs, connErr
+}
+
+// merge versions into the stored ones with CAS, so that concurrent discovery
+// of other repgroups is not lost
+func persistRepGroupVersions(ctx context.Context, cs *cluster.ClusterStore, versions map[int]int) error {
+	for attempt := 1; ; attempt++ {
+		stored, pair, err := cs.GetRepGroupVersions(ctx)
+		if err != nil {
+			return err
+		}
+		for rgid, version := range versions {
+			stored[rgid] = version
+		}
+		err = cs.AtomicPutRepGroupVersions(ctx, stored, pair)
+		if err != store.ErrKeyModified || attempt == persistVersionsMaxAttempts {
+			return err
+		}
+	}
+}
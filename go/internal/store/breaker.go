@@ -0,0 +1,54 @@
+// Copyright (c) 2019, Postgres Professional
+
+package store
+
+import (
+	"sync"
+	"time"
+)
+
+// After threshold consecutive failures (store unavailable) the breaker opens:
+// requests fail immediately with ErrStoreUnavailable for cooldown. Then one
+// probe request is let through; its success closes the breaker, failure
+// opens it for another cooldown. nil breaker is always closed.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int // consecutive
+	openedAt  time.Time
+	probing   bool
+}
+
+func (b *circuitBreaker) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return true
+	}
+	if b.probing || time.Since(b.openedAt) < b.cooldown {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+func (b *circuitBreaker) record(failed bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if !failed {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openedAt = time.Now()
+	}
+}
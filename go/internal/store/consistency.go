@@ -0,0 +1,35 @@
+// Copyright (c) 2019, Postgres Professional
+
+package store
+
+import (
+	"context"
+
+	etcdclientv3 "go.etcd.io/etcd/clientv3"
+)
+
+// Consistency of store reads
+type ReadConsistency int
+
+const (
+	// read goes through etcd quorum and always sees the latest writes;
+	// the default
+	Linearizable ReadConsistency = iota
+	// read is served locally by etcd member the client is connected to:
+	// cheaper, but might be stale
+	Serializable
+)
+
+type readConsistencyKey struct{}
+
+// Make all reads done with ctx use given consistency level
+func WithReadConsistency(ctx context.Context, rc ReadConsistency) context.Context {
+	return context.WithValue(ctx, readConsistencyKey{}, rc)
+}
+
+func readConsistencyOpts(ctx context.Context, opts []etcdclientv3.OpOption) []etcdclientv3.OpOption {
+	if rc, _ := ctx.Value(readConsistencyKey{}).(ReadConsistency); rc == Serializable {
+		return append(opts, etcdclientv3.WithSerializable())
+	}
+	return opts
+}
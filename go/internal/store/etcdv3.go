@@ -6,15 +6,26 @@ package store
 
 import (
 	"context"
+	"errors"
 	"time"
 
 	etcdclientv3 "go.etcd.io/etcd/clientv3"
+	"go.etcd.io/etcd/etcdserver/api/v3rpc/rpctypes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 const (
 	defaultRequestTimeout = 5 * time.Second
 )
 
+var (
+	ErrKeyModified = errors.New("unable to complete atomic operation, key modified")
+	ErrCompacted   = errors.New("requested revision has been compacted")
+	// circuit breaker is open, see SetCircuitBreaker
+	ErrStoreUnavailable = errors.New("store is unavailable")
+)
+
 // KVPair represents {Key, Value, Lastindex} tuple
 type KVPair struct {
 	Key       string
@@ -28,15 +39,48 @@ var DefaultEtcdEndpoints = [...]string{"http://127.0.0.1:2379"}
 type EtcdV3Store struct {
 	c              *etcdclientv3.Client
 	requestTimeout time.Duration
+	// disaster recovery store, used for reads if c is unavailable
+	fallback *etcdclientv3.Client
+	// use fallback for writes too
+	fallbackWrites bool
+	// pointers, so shared by copies of the store
+	metrics *Metrics
+	breaker *circuitBreaker // nil if disabled
 }
 
 func NewEtcdV3Store(cli *etcdclientv3.Client) EtcdV3Store {
-	return EtcdV3Store{c: cli, requestTimeout: defaultRequestTimeout}
+	return EtcdV3Store{c: cli, requestTimeout: defaultRequestTimeout, metrics: newMetrics()}
 }
 
 // requestTimeout in seconds
 func NewEtcdV3StoreWithTimout(cli *etcdclientv3.Client, requestTimeout int) EtcdV3Store {
-	return EtcdV3Store{c: cli, requestTimeout: time.Duration(requestTimeout) * time.Second}
+	return EtcdV3Store{c: cli, requestTimeout: time.Duration(requestTimeout) * time.Second,
+		metrics: newMetrics()}
+}
+
+// Set fallback (e.g. disaster recovery replica) store which is used when the
+// primary one is unavailable. If writes is false, only reads go there.
+func (s *EtcdV3Store) SetFallback(cli *etcdclientv3.Client, writes bool) {
+	s.fallback = cli
+	s.fallbackWrites = writes
+}
+
+// Requests stats of this store and its copies
+func (s *EtcdV3Store) Metrics() *Metrics {
+	return s.metrics
+}
+
+// Enable circuit breaker: after threshold consecutive failures due to store
+// unavailability, requests fail immediately with ErrStoreUnavailable (or go to
+// fallback store, if allowed) for cooldown, after which one probe request is
+// let through. threshold 0 disables the breaker. Must be called before the
+// store is copied or used concurrently.
+func (s *EtcdV3Store) SetCircuitBreaker(threshold int, cooldown time.Duration) {
+	if threshold <= 0 {
+		s.breaker = nil
+		return
+	}
+	s.breaker = &circuitBreaker{threshold: threshold, cooldown: cooldown}
 }
 
 // get underlying client
@@ -44,17 +88,121 @@ func (s *EtcdV3Store) GetClient() *etcdclientv3.Client {
 	return s.c
 }
 
-func (s *EtcdV3Store) Put(pctx context.Context, key string, value []byte) error {
-	ctx, cancel := context.WithTimeout(pctx, s.requestTimeout)
-	_, err := s.c.Put(ctx, key, string(value))
-	cancel()
+// whether request failed because store is unavailable, not because of caller
+func unavailable(pctx context.Context, err error) bool {
+	if err == nil || pctx.Err() != nil {
+		return false
+	}
+	if err == context.DeadlineExceeded || err == ErrStoreUnavailable {
+		return true
+	}
+	code := status.Code(err)
+	return code == codes.Unavailable || code == codes.DeadlineExceeded
+}
+
+// whether to retry failed request at fallback store
+func (s *EtcdV3Store) shouldFallback(pctx context.Context, err error, write bool) bool {
+	if s.fallback == nil || (write && !s.fallbackWrites) {
+		return false
+	}
+	return unavailable(pctx, err)
+}
+
+// all requests go through get, put and txn
+func (s *EtcdV3Store) get(pctx context.Context, key string, opts ...etcdclientv3.OpOption) (*etcdclientv3.GetResponse, error) {
+	start := time.Now()
+	opts = readConsistencyOpts(pctx, opts)
+	var resp *etcdclientv3.GetResponse
+	var err = ErrStoreUnavailable
+	if s.breaker.allow() {
+		ctx, cancel := context.WithTimeout(pctx, s.requestTimeout)
+		resp, err = s.c.Get(ctx, key, opts...)
+		cancel()
+		s.breaker.record(unavailable(pctx, err))
+	}
+	if s.shouldFallback(pctx, err, false) {
+		ctx, cancel := context.WithTimeout(pctx, s.requestTimeout)
+		resp, err = s.fallback.Get(ctx, key, opts...)
+		cancel()
+	}
+	s.metrics.observe(pctx, "get", start, err)
+	return resp, err
+}
+
+func (s *EtcdV3Store) put(pctx context.Context, key string, value []byte) error {
+	start := time.Now()
+	var err = ErrStoreUnavailable
+	if s.breaker.allow() {
+		ctx, cancel := context.WithTimeout(pctx, s.requestTimeout)
+		_, err = s.c.Put(ctx, key, string(value))
+		cancel()
+		s.breaker.record(unavailable(pctx, err))
+	}
+	if s.shouldFallback(pctx, err, true) {
+		ctx, cancel := context.WithTimeout(pctx, s.requestTimeout)
+		_, err = s.fallback.Put(ctx, key, string(value))
+		cancel()
+	}
+	s.metrics.observe(pctx, "put", start, err)
 	return err
 }
 
+func (s *EtcdV3Store) txn(pctx context.Context, cmps []etcdclientv3.Cmp, ops []etcdclientv3.Op) (*etcdclientv3.TxnResponse, error) {
+	start := time.Now()
+	var tresp *etcdclientv3.TxnResponse
+	var err = ErrStoreUnavailable
+	if s.breaker.allow() {
+		ctx, cancel := context.WithTimeout(pctx, s.requestTimeout)
+		tresp, err = s.c.Txn(ctx).If(cmps...).Then(ops...).Commit()
+		cancel()
+		s.breaker.record(unavailable(pctx, err))
+	}
+	if s.shouldFallback(pctx, err, true) {
+		ctx, cancel := context.WithTimeout(pctx, s.requestTimeout)
+		tresp, err = s.fallback.Txn(ctx).If(cmps...).Then(ops...).Commit()
+		cancel()
+	}
+	s.metrics.observe(pctx, "txn", start, err)
+	return tresp, err
+}
+
+func (s *EtcdV3Store) Put(pctx context.Context, key string, value []byte) error {
+	return s.put(pctx, key, value)
+}
+
 func (s *EtcdV3Store) Get(pctx context.Context, key string) (*KVPair, error) {
-	ctx, cancel := context.WithTimeout(pctx, s.requestTimeout)
-	resp, err := s.c.Get(ctx, key)
-	cancel()
+	resp, err := s.get(pctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+	kv := resp.Kvs[0]
+	return &KVPair{Key: string(kv.Key), Value: kv.Value,
+		LastIndex: uint64(kv.ModRevision)}, nil
+}
+
+// Get value along with store revision at which it was read
+func (s *EtcdV3Store) GetWithRevision(pctx context.Context, key string) (*KVPair, int64, error) {
+	resp, err := s.get(pctx, key)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, resp.Header.Revision, nil
+	}
+	kv := resp.Kvs[0]
+	return &KVPair{Key: string(kv.Key), Value: kv.Value,
+		LastIndex: uint64(kv.ModRevision)}, resp.Header.Revision, nil
+}
+
+// Get value as it was at given store revision
+func (s *EtcdV3Store) GetAtRevision(pctx context.Context, key string, rev int64) (*KVPair, error) {
+	resp, err := s.get(pctx, key, etcdclientv3.WithRev(rev))
+	if err == rpctypes.ErrCompacted {
+		return nil, ErrCompacted
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -66,6 +214,201 @@ func (s *EtcdV3Store) Get(pctx context.Context, key string) (*KVPair, error) {
 		LastIndex: uint64(kv.ModRevision)}, nil
 }
 
+// Get all keys with given prefix along with store revision at which they were
+// read; this is a single request, so result is consistent.
+func (s *EtcdV3Store) GetPrefix(pctx context.Context, prefix string) ([]*KVPair, int64, error) {
+	resp, err := s.get(pctx, prefix, etcdclientv3.WithPrefix())
+	if err != nil {
+		return nil, 0, err
+	}
+	var pairs = make([]*KVPair, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		pairs = append(pairs, &KVPair{Key: string(kv.Key), Value: kv.Value,
+			LastIndex: uint64(kv.ModRevision)})
+	}
+	return pairs, resp.Header.Revision, nil
+}
+
+// Call fn for each key with given prefix, in key order, reading them by pages
+// of pageSize keys, so that memory usage doesn't depend on number of keys.
+// All pages are read at the same store revision, which is returned; if it gets
+// compacted meanwhile, ErrCompacted is returned.
+func (s *EtcdV3Store) IteratePrefix(pctx context.Context, prefix string, pageSize int64, fn func(pair *KVPair) error) (int64, error) {
+	end := etcdclientv3.GetPrefixRangeEnd(prefix)
+	var from = prefix
+	var rev int64 = 0
+	for {
+		var opts = []etcdclientv3.OpOption{etcdclientv3.WithRange(end), etcdclientv3.WithLimit(pageSize),
+			etcdclientv3.WithSort(etcdclientv3.SortByKey, etcdclientv3.SortAscend)}
+		if rev != 0 {
+			opts = append(opts, etcdclientv3.WithRev(rev))
+		}
+		resp, err := s.get(pctx, from, opts...)
+		if err == rpctypes.ErrCompacted {
+			return 0, ErrCompacted
+		} else if err != nil {
+			return 0, err
+		}
+		if rev == 0 {
+			rev = resp.Header.Revision
+		}
+		for _, kv := range resp.Kvs {
+			err = fn(&KVPair{Key: string(kv.Key), Value: kv.Value, LastIndex: uint64(kv.ModRevision)})
+			if err != nil {
+				return 0, err
+			}
+		}
+		if !resp.More || len(resp.Kvs) == 0 {
+			return rev, nil
+		}
+		// next key after the last one
+		from = string(resp.Kvs[len(resp.Kvs)-1].Key) + "\x00"
+	}
+}
+
+// Metadata of stored key
+type KeyInfo struct {
+	Key            string
+	Size           int // of value; -1 if key was deleted while inspecting
+	ModRevision    int64
+	CreateRevision int64
+}
+
+// List keys with given prefix along with their metadata. Keys are listed
+// without values, and values are then fetched one by one to learn their sizes,
+// so huge values never end up in one huge response.
+func (s *EtcdV3Store) InspectPrefix(pctx context.Context, prefix string) ([]KeyInfo, error) {
+	resp, err := s.get(pctx, prefix, etcdclientv3.WithPrefix(), etcdclientv3.WithKeysOnly(),
+		etcdclientv3.WithSort(etcdclientv3.SortByKey, etcdclientv3.SortAscend))
+	if err != nil {
+		return nil, err
+	}
+	var infos = make([]KeyInfo, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		var info = KeyInfo{Key: string(kv.Key), Size: -1,
+			ModRevision: kv.ModRevision, CreateRevision: kv.CreateRevision}
+		vresp, err := s.get(pctx, string(kv.Key))
+		if err != nil {
+			return nil, err
+		}
+		if len(vresp.Kvs) != 0 {
+			info.Size = len(vresp.Kvs[0].Value)
+			info.ModRevision = vresp.Kvs[0].ModRevision
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// Current revision of the whole store
+func (s *EtcdV3Store) GetRevision(pctx context.Context) (int64, error) {
+	// any key will do, we need only header
+	resp, err := s.get(pctx, "/", etcdclientv3.WithCountOnly())
+	if err != nil {
+		return 0, err
+	}
+	return resp.Header.Revision, nil
+}
+
+// Number of keys with given prefix
+func (s *EtcdV3Store) CountPrefix(pctx context.Context, prefix string) (int64, error) {
+	resp, err := s.get(pctx, prefix, etcdclientv3.WithPrefix(), etcdclientv3.WithCountOnly())
+	if err != nil {
+		return 0, err
+	}
+	return resp.Count, nil
+}
+
+// Put value only if key was not modified since previous was read; if previous
+// is nil, key must not exist. Returns ErrKeyModified if condition failed. Ops
+// in also are applied in the same transaction.
+func (s *EtcdV3Store) AtomicPut(pctx context.Context, key string, value []byte, previous *KVPair, also ...Op) (*KVPair, error) {
+	var cmp etcdclientv3.Cmp
+	if previous != nil {
+		cmp = etcdclientv3.Compare(etcdclientv3.ModRevision(key), "=", int64(previous.LastIndex))
+	} else {
+		cmp = etcdclientv3.Compare(etcdclientv3.CreateRevision(key), "=", 0)
+	}
+	tresp, err := s.txn(pctx, []etcdclientv3.Cmp{cmp}, append([]etcdclientv3.Op{etcdclientv3.OpPut(key, string(value))}, etcdOps(also)...))
+	if err != nil {
+		return nil, err
+	}
+	if !tresp.Succeeded {
+		return nil, ErrKeyModified
+	}
+	revision := tresp.Responses[0].GetResponsePut().Header.Revision
+	return &KVPair{Key: key, Value: value, LastIndex: uint64(revision)}, nil
+}
+
+// Single write of AtomicMultiPut
+type Op struct {
+	Key    string
+	Value  []byte
+	Delete bool
+}
+
+// Apply all ops in one transaction, provided that each key in guards still has
+// given ModRevision (LastIndex); 0 means key must not exist. Returns
+// ErrKeyModified if some guard failed.
+func (s *EtcdV3Store) AtomicMultiPut(pctx context.Context, ops []Op, guards map[string]uint64) error {
+	var cmps = make([]etcdclientv3.Cmp, 0, len(guards))
+	for key, rev := range guards {
+		if rev != 0 {
+			cmps = append(cmps, etcdclientv3.Compare(etcdclientv3.ModRevision(key), "=", int64(rev)))
+		} else {
+			cmps = append(cmps, etcdclientv3.Compare(etcdclientv3.CreateRevision(key), "=", 0))
+		}
+	}
+	tresp, err := s.txn(pctx, cmps, etcdOps(ops))
+	if err != nil {
+		return err
+	}
+	if !tresp.Succeeded {
+		return ErrKeyModified
+	}
+	return nil
+}
+
+func etcdOps(ops []Op) []etcdclientv3.Op {
+	var etcdops = make([]etcdclientv3.Op, 0, len(ops))
+	for _, op := range ops {
+		if op.Delete {
+			etcdops = append(etcdops, etcdclientv3.OpDelete(op.Key))
+		} else {
+			etcdops = append(etcdops, etcdclientv3.OpPut(op.Key, string(op.Value)))
+		}
+	}
+	return etcdops
+}
+
+// Number of times key was put since its creation; 0 if it doesn't exist
+func (s *EtcdV3Store) GetVersion(pctx context.Context, key string) (int64, error) {
+	resp, err := s.get(pctx, key)
+	if err != nil {
+		return 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return 0, nil
+	}
+	return resp.Kvs[0].Version, nil
+}
+
+// Put empty value to key and return its new version, see GetVersion
+func (s *EtcdV3Store) Touch(pctx context.Context, key string) (int64, error) {
+	tresp, err := s.txn(pctx, nil, []etcdclientv3.Op{etcdclientv3.OpPut(key, "", etcdclientv3.WithPrevKV())})
+	if err != nil {
+		return 0, err
+	}
+	prev := tresp.Responses[0].GetResponsePut().PrevKv
+	if prev == nil {
+		return 1, nil
+	}
+	return prev.Version + 1, nil
+}
+
 func (s *EtcdV3Store) Close() error {
+	if s.fallback != nil {
+		s.fallback.Close()
+	}
 	return s.c.Close()
 }
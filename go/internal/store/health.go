@@ -0,0 +1,48 @@
+// Copyright (c) 2019, Postgres Professional
+
+package store
+
+import (
+	"context"
+	"fmt"
+)
+
+// Health of single etcd cluster member
+type MemberHealth struct {
+	Name     string
+	Endpoint string // client url used for the check
+	Healthy  bool
+	Error    string // why member is not healthy
+}
+
+// Check each member of the etcd cluster by requesting its status. Returns
+// error only if member list can't be obtained.
+func (s *EtcdV3Store) MembersHealth(pctx context.Context) ([]MemberHealth, error) {
+	ctx, cancel := context.WithTimeout(pctx, s.requestTimeout)
+	resp, err := s.c.MemberList(ctx)
+	cancel()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list etcd members: %v", err)
+	}
+	var res = make([]MemberHealth, 0, len(resp.Members))
+	for _, m := range resp.Members {
+		var mh = MemberHealth{Name: m.Name}
+		if len(m.ClientURLs) == 0 {
+			// added, but not started yet
+			mh.Error = "member has no client urls"
+			res = append(res, mh)
+			continue
+		}
+		mh.Endpoint = m.ClientURLs[0]
+		ctx, cancel := context.WithTimeout(pctx, s.requestTimeout)
+		_, err := s.c.Status(ctx, mh.Endpoint)
+		cancel()
+		if err != nil {
+			mh.Error = err.Error()
+		} else {
+			mh.Healthy = true
+		}
+		res = append(res, mh)
+	}
+	return res, nil
+}
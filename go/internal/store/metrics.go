@@ -0,0 +1,143 @@
+// Copyright (c) 2019, Postgres Professional
+
+package store
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Counters of requests to the store, by operation (get, put, txn) and
+// caller-provided label. Safe for concurrent use.
+type Metrics struct {
+	mu  sync.Mutex
+	ops map[OpLabel]*OpStats
+}
+
+type OpLabel struct {
+	Op    string
+	Label string // "" if not labeled
+}
+
+// Allowed labels of store requests, see WithMetricsLabel. Labels not listed
+// here are recorded as "other" to keep number of series bounded.
+var MetricsLabels = map[string]bool{
+	"bootstrap":   true, // cluster initialization
+	"update":      true, // planned changes of cluster configuration
+	"monitoring":  true, // reads of dashboards, health checks and the like
+	"reconcile":   true, // background reconciliation
+	"maintenance": true, // backups, upgrades, rebalance
+}
+
+const otherMetricsLabel = "other"
+
+type metricsLabelKey struct{}
+
+// Attribute store requests done with ctx to label in metrics
+func WithMetricsLabel(ctx context.Context, label string) context.Context {
+	if !MetricsLabels[label] {
+		label = otherMetricsLabel
+	}
+	return context.WithValue(ctx, metricsLabelKey{}, label)
+}
+
+func metricsLabel(ctx context.Context) string {
+	label, _ := ctx.Value(metricsLabelKey{}).(string)
+	return label
+}
+
+type OpStats struct {
+	Count    uint64
+	Errors   uint64
+	Duration time.Duration // total
+}
+
+func newMetrics() *Metrics {
+	return &Metrics{ops: make(map[OpLabel]*OpStats)}
+}
+
+func (m *Metrics) observe(ctx context.Context, op string, start time.Time, err error) {
+	d := time.Since(start)
+	key := OpLabel{Op: op, Label: metricsLabel(ctx)}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st, ok := m.ops[key]
+	if !ok {
+		st = &OpStats{}
+		m.ops[key] = st
+	}
+	st.Count++
+	st.Duration += d
+	if err != nil {
+		st.Errors++
+	}
+}
+
+// Get copy of current stats summed over labels
+func (m *Metrics) Snapshot() map[string]OpStats {
+	var res = make(map[string]OpStats)
+	for key, st := range m.LabeledSnapshot() {
+		sum := res[key.Op]
+		sum.Count += st.Count
+		sum.Errors += st.Errors
+		sum.Duration += st.Duration
+		res[key.Op] = sum
+	}
+	return res
+}
+
+// Get copy of current stats
+func (m *Metrics) LabeledSnapshot() map[OpLabel]OpStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var res = make(map[OpLabel]OpStats, len(m.ops))
+	for key, st := range m.ops {
+		res[key] = *st
+	}
+	return res
+}
+
+// Content-Type of WriteOpenMetrics output for http responses
+const OpenMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// Write stats in OpenMetrics text format, without terminating # EOF so that
+// caller can add more metric families.
+func (m *Metrics) WriteOpenMetrics(w io.Writer) error {
+	snap := m.LabeledSnapshot()
+	var ops = make([]OpLabel, 0, len(snap))
+	for key, _ := range snap {
+		ops = append(ops, key)
+	}
+	sort.Slice(ops, func(i, j int) bool {
+		if ops[i].Op != ops[j].Op {
+			return ops[i].Op < ops[j].Op
+		}
+		return ops[i].Label < ops[j].Label
+	})
+
+	var b bytes.Buffer
+	b.WriteString("# TYPE shardman_store_requests counter\n")
+	b.WriteString("# HELP shardman_store_requests Store requests.\n")
+	for _, op := range ops {
+		fmt.Fprintf(&b, "shardman_store_requests_total{op=\"%s\",label=\"%s\"} %d\n", op.Op, op.Label, snap[op].Count)
+	}
+	b.WriteString("# TYPE shardman_store_request_errors counter\n")
+	b.WriteString("# HELP shardman_store_request_errors Failed store requests.\n")
+	for _, op := range ops {
+		fmt.Fprintf(&b, "shardman_store_request_errors_total{op=\"%s\",label=\"%s\"} %d\n", op.Op, op.Label, snap[op].Errors)
+	}
+	b.WriteString("# TYPE shardman_store_request_duration_seconds summary\n")
+	b.WriteString("# UNIT shardman_store_request_duration_seconds seconds\n")
+	b.WriteString("# HELP shardman_store_request_duration_seconds Store request latencies.\n")
+	for _, op := range ops {
+		fmt.Fprintf(&b, "shardman_store_request_duration_seconds_sum{op=\"%s\",label=\"%s\"} %g\n", op.Op, op.Label, snap[op].Duration.Seconds())
+		fmt.Fprintf(&b, "shardman_store_request_duration_seconds_count{op=\"%s\",label=\"%s\"} %d\n", op.Op, op.Label, snap[op].Count)
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}